@@ -3,15 +3,46 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"maps"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -19,256 +50,6465 @@ const (
 	defaultOllamaBaseURL   = "http://localhost:11434"
 	defaultGenerateTimeout = 300 * time.Second
 	defaultListTimeout     = 10 * time.Second
+	defaultPullTimeout     = 2 * time.Hour
+	defaultDeleteTimeout   = 30 * time.Second
+
+	appVersion = "0.2.0"
 )
 
 var (
 	port              string
 	ollamaBaseURL     string
+	ollamaBackends    []string
 	generateTimeout   time.Duration
+	listTimeout       time.Duration
+	pullTimeout       time.Duration
+	deleteTimeout     time.Duration
 	ollamaGenerateAPI string
 	ollamaChatAPI     string
 	ollamaTagsAPI     string
 	ollamaPullAPI     string
 	ollamaDeleteAPI   string
+	ollamaShowAPI     string
+	ollamaVersionAPI  string
+	ollamaCopyAPI     string
+	ollamaPsAPI       string
+
+	apiToken               string
+	allowRemoteShutdown    bool
+	corsAllowOrigins       []string
+	otlpEndpoint           string
+	otelServiceName        string
+	ollamaModelsDir        string
+	upstreamUserAgent      string
+	unreachableMessage     string
+	chatWelcomeMessage     string
+	sessionSecret          []byte
+	webhookSecret          []byte
+	sessionIdleTimeout     time.Duration
+	trimResponse           bool
+	auditLogPath           string
+	auditRedactImages      bool
+	ollamaLogPath          string
+	ollamaLogSource        string
+	invalidUTF8Mode        string
+	loadingInterval        time.Duration
+	gpuCardPath            string
+	telemetryInterval      time.Duration
+	telemetryReadTimeout   time.Duration
+	gpuVramTotal           uint64
+	eventsPollInterval     time.Duration
+	healthInterval         time.Duration
+	healthThreshold        int
+	hourlyTokenBudget      int
+	clientTokenQuota       int
+	clientQuotaWindow      time.Duration
+	keepWarmModels         []string
+	keepWarmInterval       time.Duration
+	keepWarmKeepAlive      time.Duration
+	loadRetryAfter         time.Duration
+	upstreamIdleTimeout    time.Duration
+	streamFirstByteRetries int
+	pullRetries            int
+	gzipMinBytes           int
+	gzipMinVersion         string
+	modelUsagePath         string
+	repetitionRepeats      int
+	repetitionMinCycle     int
+	repetitionMaxCycle     int
+	thinkDefault           *bool
+	splitThinkingDefault   bool
+	mergeRolesDefault      bool
+	sseNamedEvents         bool
+	singleSystemDefault    bool
+	streamDefault          bool
+	maxRequestDeadline     time.Duration
+	maxSSEConnections      int
+	promptSampleRate       float64
+	fieldAliases           map[string]string
+	contentFilters         []contentFilterRule
+	contentFilterTail      int
+	generateTemplate       *template.Template
+	enabledActions         map[string]bool
+	configFile             string
+	fileConfig             map[string]string
+	pullSlots              chan struct{}
+	pullQueueWhenFull      bool
 )
 
 func init() {
+	configFile = os.Getenv("CONFIG_FILE")
+	required := configFile != ""
+	if !required {
+		configFile = "config.yaml"
+	}
+	cfg, err := loadConfigFile(configFile)
+	switch {
+	case err == nil:
+		fileConfig = cfg
+	case required || !errors.Is(err, fs.ErrNotExist):
+		log.Fatalf("Config file %s: %v", configFile, err)
+	default:
+		configFile = ""
+	}
+
 	port = getEnv("PORT", defaultPort)
 	ollamaBaseURL = getEnv("OLLAMA_BASE_URL", defaultOllamaBaseURL)
+	ollamaBackends = []string{ollamaBaseURL}
+	for _, b := range splitList(configValue("OLLAMA_BACKENDS")) {
+		if b = strings.TrimSuffix(b, "/"); !slices.Contains(ollamaBackends, b) {
+			ollamaBackends = append(ollamaBackends, b)
+		}
+	}
+
+	generateTimeout = getEnvSeconds("GENERATE_TIMEOUT_SEC", defaultGenerateTimeout)
+	listTimeout = getEnvSeconds("LIST_TIMEOUT_SEC", defaultListTimeout)
+	pullTimeout = getEnvSeconds("PULL_TIMEOUT_SEC", defaultPullTimeout)
+	deleteTimeout = getEnvSeconds("DELETE_TIMEOUT_SEC", defaultDeleteTimeout)
 
-	timeoutSec, _ := strconv.Atoi(getEnv("GENERATE_TIMEOUT_SEC", "300"))
-	generateTimeout = time.Duration(timeoutSec) * time.Second
+	generateClient = &http.Client{Timeout: generateTimeout, Transport: upstreamTransport}
+	listClient = &http.Client{Timeout: listTimeout, Transport: upstreamTransport}
+	pullClient = &http.Client{Timeout: pullTimeout, Transport: upstreamTransport}
+	deleteClient = &http.Client{Timeout: deleteTimeout, Transport: upstreamTransport}
 
 	ollamaGenerateAPI = ollamaBaseURL + "/api/generate"
 	ollamaChatAPI = ollamaBaseURL + "/api/chat"
 	ollamaTagsAPI = ollamaBaseURL + "/api/tags"
 	ollamaPullAPI = ollamaBaseURL + "/api/pull"
 	ollamaDeleteAPI = ollamaBaseURL + "/api/delete"
+	ollamaShowAPI = ollamaBaseURL + "/api/show"
+	ollamaVersionAPI = ollamaBaseURL + "/api/version"
+	ollamaCopyAPI = ollamaBaseURL + "/api/copy"
+	ollamaPsAPI = ollamaBaseURL + "/api/ps"
+
+	apiToken = configValue("API_TOKEN")
+	allowRemoteShutdown = getEnv("ALLOW_REMOTE_SHUTDOWN", "false") == "true"
+	corsAllowOrigins = splitList(configValue("CORS_ALLOW_ORIGINS"))
+	actions := splitList(configValue("ENABLED_ACTIONS"))
+	if len(actions) == 0 {
+		actions = allActions
+	}
+	enabledActions = make(map[string]bool)
+	for _, action := range actions {
+		if !slices.Contains(allActions, action) {
+			log.Fatalf("ENABLED_ACTIONS: unknown action %q (want %s)", action, strings.Join(allActions, ", "))
+		}
+		enabledActions[action] = true
+	}
+
+	otlpEndpoint = configValue("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if otlpEndpoint != "" && !strings.HasSuffix(otlpEndpoint, "/v1/traces") {
+		otlpEndpoint = strings.TrimSuffix(otlpEndpoint, "/") + "/v1/traces"
+	}
+	otelServiceName = getEnv("OTEL_SERVICE_NAME", "webolla")
+	upstreamUserAgent = getEnv("OLLAMA_USER_AGENT", "webolla/"+appVersion)
+	unreachableMessage = getEnv("OLLAMA_UNREACHABLE_MESSAGE", fmt.Sprintf("Could not connect to Ollama at %s.", redactURL(ollamaBaseURL)))
+	chatWelcomeMessage = configValue("CHAT_WELCOME_MESSAGE")
+
+	sessionSecret = []byte(configValue("SESSION_SECRET"))
+	if len(sessionSecret) == 0 {
+		sessionSecret = make([]byte, 32)
+		rand.Read(sessionSecret)
+	}
+	sessionIdleTimeout = time.Duration(getEnvInt("SESSION_IDLE_MIN", 60)) * time.Minute
+	webhookSecret = []byte(configValue("WEBHOOK_SECRET"))
+	trimResponse = getEnv("TRIM_RESPONSE", "false") == "true"
+	auditLogPath = configValue("AUDIT_LOG_PATH")
+	auditRedactImages = getEnv("AUDIT_REDACT_IMAGES", "true") != "false"
+	ollamaLogPath = configValue("OLLAMA_LOG_PATH")
+	ollamaLogSource = getEnv("OLLAMA_LOG_SOURCE", "file")
+	invalidUTF8Mode = getEnv("INVALID_UTF8", "replace")
+	promptSampleRate = 1
+	if v, err := strconv.ParseFloat(configValue("PROMPT_LOG_SAMPLE_RATE"), 64); err == nil {
+		promptSampleRate = min(max(v, 0), 1)
+	}
+	loadingInterval = time.Duration(getEnvInt("LOADING_EVENT_INTERVAL_MS", 1000)) * time.Millisecond
+
+	gpuCardPath = getEnv("GPU_CARD_PATH", "/sys/class/drm/card0")
+	telemetryInterval = time.Duration(getEnvInt("TELEMETRY_INTERVAL_MS", 1000)) * time.Millisecond
+	telemetryReadTimeout = time.Duration(getEnvInt("TELEMETRY_READ_TIMEOUT_MS", 500)) * time.Millisecond
+	gpuVramTotal = uint64(max(getEnvInt("GPU_VRAM_TOTAL_MB", 0), 0)) << 20
+
+	eventsPollInterval = getEnvSeconds("EVENTS_POLL_SEC", 5*time.Second)
+	healthInterval = getEnvSeconds("HEALTH_INTERVAL_SEC", 5*time.Second)
+	healthThreshold = max(getEnvInt("HEALTH_FAILURE_THRESHOLD", 3), 1)
+	hourlyTokenBudget = getEnvInt("HOURLY_TOKEN_BUDGET", 0)
+	tokenBudget.limit, tokenBudget.period = hourlyTokenBudget, time.Hour
+	clientTokenQuota = getEnvInt("CLIENT_TOKEN_QUOTA", 0)
+	clientQuotaWindow = getEnvSeconds("CLIENT_QUOTA_WINDOW_SEC", time.Hour)
+	keepWarmModels = splitList(configValue("KEEP_WARM_MODELS"))
+	for i, m := range keepWarmModels {
+		keepWarmModels[i] = fullModelName(m)
+	}
+	keepWarmInterval = getEnvSeconds("KEEP_WARM_INTERVAL_SEC", 4*time.Minute)
+	keepWarmKeepAlive, _ = time.ParseDuration(getEnv("KEEP_WARM_KEEP_ALIVE", "5m"))
+	loadRetryAfter = getEnvSeconds("LOAD_RETRY_AFTER_SEC", 5*time.Second)
+	upstreamIdleTimeout = getEnvSeconds("UPSTREAM_IDLE_TIMEOUT_SEC", 2*time.Minute)
+	streamFirstByteRetries = max(getEnvInt("STREAM_FIRST_BYTE_RETRIES", 0), 0)
+	pullRetries = max(getEnvInt("PULL_RETRIES", 3), 0)
+	gzipMinBytes = max(getEnvInt("UPSTREAM_GZIP_MIN_BYTES", 0), 0)
+	gzipMinVersion = configValue("UPSTREAM_GZIP_MIN_VERSION")
+	modelUsagePath = getEnv("MODEL_USAGE_PATH", "")
+	repetitionRepeats = max(getEnvInt("REPETITION_STOP_REPEATS", 0), 0)
+	repetitionMinCycle = max(getEnvInt("REPETITION_MIN_CYCLE_CHARS", 12), 1)
+	repetitionMaxCycle = max(getEnvInt("REPETITION_MAX_CYCLE_CHARS", 400), repetitionMinCycle)
+	maxRequestDeadline = getEnvSeconds("MAX_REQUEST_DEADLINE_SEC", pullTimeout)
+	maxSSEConnections = getEnvInt("MAX_SSE_CONNECTIONS", 256)
+	if path := configValue("CONTENT_FILTERS"); path != "" {
+		if contentFilters, err = loadContentFilters(path); err != nil {
+			log.Fatalf("Content filters %s: %v", path, err)
+		}
+	}
+	contentFilterTail = max(getEnvInt("CONTENT_FILTER_TAIL_CHARS", 64), 0)
+	if text := configValue("GENERATE_TEMPLATE"); text != "" {
+		if generateTemplate, err = parseGenerateTemplate(text); err != nil {
+			log.Fatalf("GENERATE_TEMPLATE: %v", err)
+		}
+	}
+	if v, err := strconv.ParseBool(configValue("THINK_DEFAULT")); err == nil {
+		thinkDefault = &v
+	}
+	splitThinkingDefault = getEnv("SPLIT_THINKING", "true") != "false"
+	mergeRolesDefault = getEnv("MERGE_CONSECUTIVE_ROLES", "false") == "true"
+	sseNamedEvents = getEnv("SSE_NAMED_EVENTS", "false") == "true"
+	singleSystemDefault = getEnv("ENFORCE_SINGLE_SYSTEM", "false") == "true"
+	streamDefault = true
+	if v, err := strconv.ParseBool(configValue("DEFAULT_STREAM")); err == nil {
+		streamDefault = v
+	}
+
+	pullSlots = make(chan struct{}, max(getEnvInt("MAX_CONCURRENT_PULLS", 1), 1))
+	pullQueueWhenFull = getEnv("PULL_LIMIT_MODE", "queue") != "reject"
+	generations.limit = max(getEnvInt("MAX_CONCURRENT_GENERATIONS", 0), 0)
+
+	fieldAliases = make(map[string]string)
+	for _, pair := range splitList(configValue("FIELD_ALIASES")) {
+		if alias, canonical, ok := strings.Cut(pair, ":"); ok {
+			fieldAliases[strings.TrimSpace(alias)] = strings.TrimSpace(canonical)
+		}
+	}
+
+	ollamaModelsDir = configValue("OLLAMA_MODELS")
+	if ollamaModelsDir == "" {
+		home, _ := os.UserHomeDir()
+		ollamaModelsDir = filepath.Join(home, ".ollama", "models")
+	}
+}
+
+// validateConfig checks the settings that would otherwise only fail, or
+// silently fall back to a default, once the server is running. It returns
+// one line per problem.
+func validateConfig() []string {
+	var problems []string
+	if u, err := url.Parse(ollamaBaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("OLLAMA_BASE_URL %q is not an http(s) URL with a host, e.g. http://localhost:11434", ollamaBaseURL))
+	}
+	for _, b := range ollamaBackends[1:] {
+		if u, err := url.Parse(b); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("OLLAMA_BACKENDS entry %q is not an http(s) URL with a host", b))
+		}
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		problems = append(problems, fmt.Sprintf("PORT %q is not a port number between 1 and 65535", port))
+	}
+
+	positive := map[string]string{
+		"GENERATE_TIMEOUT_SEC":      "seconds",
+		"LIST_TIMEOUT_SEC":          "seconds",
+		"PULL_TIMEOUT_SEC":          "seconds",
+		"DELETE_TIMEOUT_SEC":        "seconds",
+		"MAX_REQUEST_DEADLINE_SEC":  "seconds",
+		"HEALTH_INTERVAL_SEC":       "seconds",
+		"EVENTS_POLL_SEC":           "seconds",
+		"CLIENT_QUOTA_WINDOW_SEC":   "seconds",
+		"KEEP_WARM_INTERVAL_SEC":    "seconds",
+		"TELEMETRY_INTERVAL_MS":     "milliseconds",
+		"LOADING_EVENT_INTERVAL_MS": "milliseconds",
+	}
+	for _, key := range slices.Sorted(maps.Keys(positive)) {
+		v := configValue(key)
+		if v == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(v); err != nil || n <= 0 {
+			problems = append(problems, fmt.Sprintf("%s %q must be a positive whole number of %s", key, v, positive[key]))
+		}
+	}
+
+	if auditLogPath != "" {
+		if info, err := os.Stat(filepath.Dir(auditLogPath)); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("AUDIT_LOG_PATH %q: directory %s does not exist", auditLogPath, filepath.Dir(auditLogPath)))
+		}
+	}
+	if ollamaLogSource != "file" && ollamaLogSource != "journald" {
+		problems = append(problems, fmt.Sprintf("OLLAMA_LOG_SOURCE %q must be file or journald", ollamaLogSource))
+	}
+	if len(keepWarmModels) > 0 {
+		if keepWarmKeepAlive <= 0 {
+			problems = append(problems, fmt.Sprintf("KEEP_WARM_KEEP_ALIVE %q must be a positive duration, e.g. 5m", getEnv("KEEP_WARM_KEEP_ALIVE", "5m")))
+		} else if keepWarmInterval >= keepWarmKeepAlive {
+			problems = append(problems, fmt.Sprintf("KEEP_WARM_INTERVAL_SEC (%s) must be shorter than KEEP_WARM_KEEP_ALIVE (%s) or models expire between pings", keepWarmInterval, keepWarmKeepAlive))
+		}
+	}
+	if invalidUTF8Mode != "replace" && invalidUTF8Mode != "drop" {
+		problems = append(problems, fmt.Sprintf("INVALID_UTF8 %q must be replace or drop", invalidUTF8Mode))
+	}
+	if dir := configValue("OLLAMA_MODELS"); dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("OLLAMA_MODELS %q is not a readable directory", dir))
+		}
+	}
+	return problems
+}
+
+// ConfigSetting is one entry of /api/config: the value in effect and
+// whether it came from the environment, the config file or the default.
+type ConfigSetting struct {
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+const redacted = "[redacted]"
+
+// effectiveConfig resolves every setting the way init did, keyed by its
+// environment variable. Secrets are never included.
+func effectiveConfig() map[string]ConfigSetting {
+	secret := func(v string) string {
+		if v == "" {
+			return ""
+		}
+		return redacted
+	}
+	think := interface{}(nil)
+	if thinkDefault != nil {
+		think = *thinkDefault
+	}
+	actions := make([]string, 0, len(enabledActions))
+	for _, a := range allActions {
+		if enabledActions[a] {
+			actions = append(actions, a)
+		}
+	}
+	values := map[string]interface{}{
+		"PORT":                        port,
+		"OLLAMA_BASE_URL":             redactURL(ollamaBaseURL),
+		"OLLAMA_BACKENDS":             redactBackends(),
+		"GENERATE_TIMEOUT_SEC":        generateTimeout.String(),
+		"LIST_TIMEOUT_SEC":            listTimeout.String(),
+		"PULL_TIMEOUT_SEC":            pullTimeout.String(),
+		"DELETE_TIMEOUT_SEC":          deleteTimeout.String(),
+		"API_TOKEN":                   secret(apiToken),
+		"SESSION_SECRET":              secret(configValue("SESSION_SECRET")),
+		"WEBHOOK_SECRET":              secret(string(webhookSecret)),
+		"ALLOW_REMOTE_SHUTDOWN":       allowRemoteShutdown,
+		"CORS_ALLOW_ORIGINS":          corsAllowOrigins,
+		"ENABLED_ACTIONS":             actions,
+		"OTEL_EXPORTER_OTLP_ENDPOINT": redactURL(otlpEndpoint),
+		"OTEL_SERVICE_NAME":           otelServiceName,
+		"OLLAMA_USER_AGENT":           upstreamUserAgent,
+		"OLLAMA_UNREACHABLE_MESSAGE":  unreachableMessage,
+		"CHAT_WELCOME_MESSAGE":        chatWelcomeMessage,
+		"SESSION_IDLE_MIN":            sessionIdleTimeout.String(),
+		"TRIM_RESPONSE":               trimResponse,
+		"AUDIT_LOG_PATH":              auditLogPath,
+		"AUDIT_REDACT_IMAGES":         auditRedactImages,
+		"OLLAMA_LOG_PATH":             ollamaLogPath,
+		"OLLAMA_LOG_SOURCE":           ollamaLogSource,
+		"INVALID_UTF8":                invalidUTF8Mode,
+		"PROMPT_LOG_SAMPLE_RATE":      promptSampleRate,
+		"LOADING_EVENT_INTERVAL_MS":   loadingInterval.String(),
+		"GPU_CARD_PATH":               gpuCardPath,
+		"TELEMETRY_INTERVAL_MS":       telemetryInterval.String(),
+		"TELEMETRY_READ_TIMEOUT_MS":   telemetryReadTimeout.String(),
+		"GPU_VRAM_TOTAL_MB":           gpuVramTotal >> 20,
+		"EVENTS_POLL_SEC":             eventsPollInterval.String(),
+		"HEALTH_INTERVAL_SEC":         healthInterval.String(),
+		"HEALTH_FAILURE_THRESHOLD":    healthThreshold,
+		"HOURLY_TOKEN_BUDGET":         hourlyTokenBudget,
+		"CLIENT_TOKEN_QUOTA":          clientTokenQuota,
+		"CLIENT_QUOTA_WINDOW_SEC":     clientQuotaWindow.String(),
+		"KEEP_WARM_MODELS":            keepWarmModels,
+		"KEEP_WARM_INTERVAL_SEC":      keepWarmInterval.String(),
+		"KEEP_WARM_KEEP_ALIVE":        keepWarmKeepAlive.String(),
+		"LOAD_RETRY_AFTER_SEC":        loadRetryAfter.String(),
+		"UPSTREAM_IDLE_TIMEOUT_SEC":   upstreamIdleTimeout.String(),
+		"STREAM_FIRST_BYTE_RETRIES":   streamFirstByteRetries,
+		"PULL_RETRIES":                pullRetries,
+		"UPSTREAM_GZIP_MIN_BYTES":     gzipMinBytes,
+		"UPSTREAM_GZIP_MIN_VERSION":   gzipMinVersion,
+		"MODEL_USAGE_PATH":            modelUsagePath,
+		"REPETITION_STOP_REPEATS":     repetitionRepeats,
+		"REPETITION_MIN_CYCLE_CHARS":  repetitionMinCycle,
+		"REPETITION_MAX_CYCLE_CHARS":  repetitionMaxCycle,
+		"MAX_REQUEST_DEADLINE_SEC":    maxRequestDeadline.String(),
+		"MAX_SSE_CONNECTIONS":         maxSSEConnections,
+		"CONTENT_FILTERS":             configValue("CONTENT_FILTERS"),
+		"CONTENT_FILTER_TAIL_CHARS":   contentFilterTail,
+		"GENERATE_TEMPLATE":           configValue("GENERATE_TEMPLATE"),
+		"THINK_DEFAULT":               think,
+		"SPLIT_THINKING":              splitThinkingDefault,
+		"MERGE_CONSECUTIVE_ROLES":     mergeRolesDefault,
+		"SSE_NAMED_EVENTS":            sseNamedEvents,
+		"ENFORCE_SINGLE_SYSTEM":       singleSystemDefault,
+		"DEFAULT_STREAM":              streamDefault,
+		"MAX_CONCURRENT_PULLS":        cap(pullSlots),
+		"PULL_LIMIT_MODE":             map[bool]string{true: "queue", false: "reject"}[pullQueueWhenFull],
+		"MAX_CONCURRENT_GENERATIONS":  generations.limit,
+		"FIELD_ALIASES":               fieldAliases,
+		"OLLAMA_MODELS":               ollamaModelsDir,
+	}
+
+	settings := make(map[string]ConfigSetting, len(values))
+	for key, v := range values {
+		source := "default"
+		if os.Getenv(key) != "" {
+			source = "env"
+		} else if fileConfig[key] != "" {
+			source = "file"
+		}
+		settings[key] = ConfigSetting{Value: v, Source: source}
+	}
+	return settings
+}
+
+func redactBackends() []string {
+	backends := make([]string, len(ollamaBackends))
+	for i, b := range ollamaBackends {
+		backends[i] = redactURL(b)
+	}
+	return backends
+}
+
+// redactURL hides the password in a URL's user info, if any.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	return u.Redacted()
+}
+
+// configValue returns the environment variable key, falling back to the
+// config file entry of the same name (lower-cased in the file, e.g. port,
+// ollama_base_url). The environment always wins.
+func configValue(key string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fileConfig[key]
+}
+
+func getEnv(key, def string) string {
+	if v := configValue(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func getEnvInt(key string, def int) int {
+	if n, err := strconv.Atoi(configValue(key)); err == nil {
+		return n
+	}
+	return def
+}
+
+// getEnvSeconds reads a whole number of seconds from the environment.
+func getEnvSeconds(key string, def time.Duration) time.Duration {
+	if sec, err := strconv.Atoi(configValue(key)); err == nil {
+		return time.Duration(sec) * time.Second
+	}
+	return def
+}
+
+// loadConfigFile reads a YAML settings file: a mapping of setting names to
+// scalars, or to lists of scalars, which are joined with commas the same as
+// their env counterparts. Keys are returned as env names. Anything nested
+// deeper is rejected rather than guessed at.
+func loadConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	cfg := make(map[string]string)
+	if len(doc.Content) == 0 {
+		return cfg, nil
+	}
+	root := resolveYAMLAlias(doc.Content[0])
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: expected a mapping of settings", root.Line)
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], resolveYAMLAlias(root.Content[i+1])
+		name := strings.ToUpper(key.Value)
+		switch value.Kind {
+		case yaml.ScalarNode:
+			if value.Tag != "!!null" {
+				cfg[name] = value.Value
+			}
+		case yaml.SequenceNode:
+			items := make([]string, 0, len(value.Content))
+			for _, item := range value.Content {
+				if item = resolveYAMLAlias(item); item.Kind != yaml.ScalarNode {
+					return nil, fmt.Errorf("line %d: %s: list items must be plain values", item.Line, key.Value)
+				}
+				items = append(items, item.Value)
+			}
+			cfg[name] = strings.Join(items, ",")
+		default:
+			return nil, fmt.Errorf("line %d: %s: nested settings are not supported", value.Line, key.Value)
+		}
+	}
+	return cfg, nil
+}
+
+func resolveYAMLAlias(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	return n
+}
+
+// splitList parses a comma-separated env value, dropping empty entries.
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+type GenerationParams struct {
+	Temperature   float64  `json:"temperature"`
+	TopP          float64  `json:"top_p"`
+	TopK          int      `json:"top_k"`
+	RepeatPenalty float64  `json:"repeat_penalty"`
+	NumPredict    int      `json:"num_predict"`
+	Stop          []string `json:"stop,omitempty"`
+	Logprobs      bool     `json:"logprobs,omitempty"`
+	TopLogprobs   int      `json:"top_logprobs,omitempty"`
+}
+
+type OllamaGenerateRequestPayload struct {
+	Model   string                 `json:"model"`
+	Prompt  string                 `json:"prompt"`
+	Stream  bool                   `json:"stream"`
+	Options map[string]interface{} `json:"options,omitempty"`
+	Context []int                  `json:"context,omitempty"`
+	Think   *bool                  `json:"think,omitempty"`
+	Images  []string               `json:"images,omitempty"`
+	// KeepAlive is how long Ollama keeps the model loaded afterwards,
+	// e.g. "5m"; empty leaves Ollama's default.
+	KeepAlive string `json:"keep_alive,omitempty"`
+}
+
+type OllamaChatRequestPayload struct {
+	Model    string                 `json:"model"`
+	Messages []Message              `json:"messages"`
+	Tools    []json.RawMessage      `json:"tools,omitempty"`
+	Stream   bool                   `json:"stream"`
+	Options  map[string]interface{} `json:"options,omitempty"`
+	Think    *bool                  `json:"think,omitempty"`
+	// KeepAlive is as on OllamaGenerateRequestPayload.
+	KeepAlive string `json:"keep_alive,omitempty"`
+}
+
+type Message struct {
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	Thinking   string     `json:"thinking,omitempty"`
+	Images     []string   `json:"images,omitempty"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+	// DisplayOnly marks a message the UI shows but the model never sees,
+	// such as the CHAT_WELCOME_MESSAGE greeting.
+	DisplayOnly bool `json:"display_only,omitempty"`
+}
+
+type ToolCall struct {
+	ID       string           `json:"id,omitempty"`
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	// Index says which call a streamed fragment belongs to.
+	Index     *int            `json:"index,omitempty"`
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+type OllamaModelActionPayload struct {
+	Model string `json:"name"`
+}
+
+type OllamaResponseChunk struct {
+	Model           string   `json:"model"`
+	Response        string   `json:"response"`
+	Message         *Message `json:"message,omitempty"`
+	Done            bool     `json:"done"`
+	DoneReason      string   `json:"done_reason,omitempty"`
+	Error           string   `json:"error,omitempty"`
+	TotalDuration   int64    `json:"total_duration,omitempty"`
+	LoadDuration    int64    `json:"load_duration,omitempty"`
+	PromptEvalCount int      `json:"prompt_eval_count,omitempty"`
+	EvalCount       int      `json:"eval_count,omitempty"`
+	EvalDuration    int64    `json:"eval_duration,omitempty"`
+	// Context is returned on the final generate chunk; sending it back with
+	// the next prompt continues the conversation.
+	Context []int `json:"context,omitempty"`
+	// Logprobs is passed through untouched when the model reports it.
+	Logprobs json.RawMessage `json:"logprobs,omitempty"`
+	// Detail keeps Ollama's own wording when Error has been explained.
+	Detail string `json:"detail,omitempty"`
+	// Thinking is a reasoning model's thinking on generate; chat carries
+	// it in Message.Thinking.
+	Thinking string `json:"thinking,omitempty"`
+}
+
+// takeThinking removes and returns the chunk's thinking text.
+func (c *OllamaResponseChunk) takeThinking() string {
+	thinking := c.Thinking
+	c.Thinking = ""
+	if c.Message != nil {
+		thinking += c.Message.Thinking
+		c.Message.Thinking = ""
+	}
+	return thinking
+}
+
+// takeToolCalls removes and returns the chunk's tool calls.
+func (c *OllamaResponseChunk) takeToolCalls() []ToolCall {
+	if c.Message == nil {
+		return nil
+	}
+	calls := c.Message.ToolCalls
+	c.Message.ToolCalls = nil
+	return calls
+}
+
+// ToolCallDelta is streamed as a tool call is built up, so clients can show
+// it before the model is done. Arguments is the newly arrived text.
+type ToolCallDelta struct {
+	Type      string `json:"type"`
+	Index     int    `json:"index"`
+	ID        string `json:"id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+}
+
+// toolCallBuilder assembles the tool calls of one reply. Ollama usually
+// sends each call whole, with its arguments as an object; OpenAI-style
+// backends send the name first and the arguments as string fragments over
+// many chunks, tied together by function.index.
+type toolCallBuilder struct {
+	calls []*partialToolCall
+}
+
+type partialToolCall struct {
+	id, name string
+	args     strings.Builder
+}
+
+// add merges one streamed call and returns the delta to forward.
+func (b *toolCallBuilder) add(tc ToolCall) ToolCallDelta {
+	var fragment string
+	whole := len(tc.Function.Arguments) > 0 && json.Unmarshal(tc.Function.Arguments, &fragment) != nil
+	if whole {
+		fragment = string(tc.Function.Arguments)
+	}
+
+	// Without an index, a whole call or a new name starts a new call and
+	// anything else continues the last one. An index past the next free
+	// slot, or a negative one, comes from upstream unchecked; it starts a
+	// new call rather than growing the slice to match.
+	i := len(b.calls)
+	switch {
+	case tc.Function.Index != nil:
+		if n := *tc.Function.Index; n >= 0 && n < len(b.calls) {
+			i = n
+		}
+	case !whole && tc.Function.Name == "" && len(b.calls) > 0:
+		i = len(b.calls) - 1
+	}
+	for len(b.calls) <= i {
+		b.calls = append(b.calls, &partialToolCall{})
+	}
+	call := b.calls[i]
+	call.id = cmp.Or(tc.ID, call.id)
+	call.name = cmp.Or(tc.Function.Name, call.name)
+	if whole {
+		call.args.Reset()
+	}
+	call.args.WriteString(fragment)
+
+	return ToolCallDelta{Type: "tool_call_delta", Index: i, ID: tc.ID, Name: tc.Function.Name, Arguments: fragment}
+}
+
+// result returns the finished calls. Arguments that did not add up to
+// valid JSON are passed on as a string rather than dropped.
+func (b *toolCallBuilder) result() []ToolCall {
+	calls := make([]ToolCall, 0, len(b.calls))
+	for i, c := range b.calls {
+		if c.name == "" && c.args.Len() == 0 {
+			continue
+		}
+		args := json.RawMessage(c.args.String())
+		if !json.Valid(args) {
+			args, _ = json.Marshal(c.args.String())
+		}
+		calls = append(calls, ToolCall{ID: c.id, Function: ToolCallFunction{Index: &i, Name: c.name, Arguments: args}})
+	}
+	return calls
+}
+
+// StreamStats is the final SSE event of a generation, sent after the done chunk.
+type StreamStats struct {
+	Type            string `json:"type"`
+	Model           string `json:"model"`
+	DoneReason      string `json:"done_reason"`
+	TotalDuration   int64  `json:"total_duration"`
+	LoadDuration    int64  `json:"load_duration"`
+	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
+	EvalDuration    int64  `json:"eval_duration"`
+	ResponseSHA256  string `json:"response_sha256"`
+}
+
+func (c *OllamaResponseChunk) content() string {
+	if c.Message != nil {
+		return c.Message.Content
+	}
+	return c.Response
+}
+
+func (c *OllamaResponseChunk) setContent(text string) {
+	if c.Message != nil {
+		c.Message.Content = text
+	} else {
+		c.Response = text
+	}
+}
+
+type ClientRequest struct {
+	ActionType string           `json:"actionType"`
+	Model      string           `json:"model"`
+	Prompt     string           `json:"prompt"`
+	Messages   []Message        `json:"messages"`
+	Params     GenerationParams `json:"params"`
+	SessionID  string           `json:"sessionId"`
+	// Tools are passed through to Ollama's chat API unchanged.
+	Tools []json.RawMessage `json:"tools,omitempty"`
+	// TrimLeadingWhitespace overrides TRIM_RESPONSE for this request.
+	TrimLeadingWhitespace *bool `json:"trimLeadingWhitespace,omitempty"`
+	// AssistantPrefix seeds the assistant's reply; the model continues it.
+	AssistantPrefix string `json:"assistantPrefix,omitempty"`
+	// Context continues a previous generate without resending its prompt.
+	Context []int `json:"context,omitempty"`
+	// Images go with a generate prompt, in order; chat carries them per
+	// message instead.
+	Images []string `json:"images,omitempty"`
+	// AllowEmptyPrompt lets an empty prompt (or last user message) through,
+	// e.g. to continue from AssistantPrefix.
+	AllowEmptyPrompt bool `json:"allowEmptyPrompt,omitempty"`
+	// IncludeTelemetry interleaves GPU stats into the stream every second.
+	IncludeTelemetry bool `json:"includeTelemetry,omitempty"`
+	// Stream set to false returns the whole reply in one response instead
+	// of an SSE stream.
+	Stream *bool `json:"stream,omitempty"`
+	// StopOnRepetition turns the loop detector on or off for this request,
+	// overriding REPETITION_STOP_REPEATS.
+	StopOnRepetition *bool `json:"stopOnRepetition,omitempty"`
+	// Think turns a reasoning model's thinking on or off; unset falls back
+	// to THINK_DEFAULT, and then to the model's own default.
+	Think *bool `json:"think,omitempty"`
+	// SplitThinking sends thinking as separate "thinking" events; false
+	// folds it into the content inside <think> tags, for clients that only
+	// read one stream. Unset falls back to SPLIT_THINKING.
+	SplitThinking *bool `json:"splitThinking,omitempty"`
+	// ConversationID continues a chat kept server-side in the browser
+	// session: Messages are only the new ones, appended to its history.
+	ConversationID string `json:"conversationId,omitempty"`
+	// Destination is the new name for the copy action; Model is the source.
+	Destination string `json:"destination,omitempty"`
+	// RequestID names the request for POST /api/cancel; X-Request-ID
+	// does the same for clients that can set headers.
+	RequestID string `json:"requestId,omitempty"`
+	// MergeConsecutiveRoles joins adjacent messages from the same role into
+	// one before they go upstream; unset falls back to
+	// MERGE_CONSECUTIVE_ROLES.
+	MergeConsecutiveRoles *bool `json:"mergeConsecutiveRoles,omitempty"`
+	// EnforceSingleSystem gathers every system message into one at the
+	// front; unset falls back to ENFORCE_SINGLE_SYSTEM.
+	EnforceSingleSystem *bool `json:"enforceSingleSystem,omitempty"`
+	// KeepAlive is how long the model stays loaded after this request:
+	// a duration like "5m", "0" to unload at once, or a negative value to
+	// keep it loaded until Ollama exits.
+	KeepAlive string `json:"keepAlive,omitempty"`
+
+	// conv is the conversation the reply is recorded in, if any.
+	conv *conversation
+}
+
+func (req ClientRequest) splitThinking() bool {
+	if req.SplitThinking != nil {
+		return *req.SplitThinking
+	}
+	return splitThinkingDefault
+}
+
+func (req ClientRequest) mergeConsecutiveRoles() bool {
+	if req.MergeConsecutiveRoles != nil {
+		return *req.MergeConsecutiveRoles
+	}
+	return mergeRolesDefault
+}
+
+func (req ClientRequest) enforceSingleSystem() bool {
+	if req.EnforceSingleSystem != nil {
+		return *req.EnforceSingleSystem
+	}
+	return singleSystemDefault
+}
+
+// think resolves the think setting to send upstream, or nil to send none.
+func (req ClientRequest) think() *bool {
+	if !ollamaSupports("think") {
+		return nil
+	}
+	if req.Think != nil {
+		return req.Think
+	}
+	return thinkDefault
+}
+
+type TelemetryEvent struct {
+	Type string `json:"type"`
+	GpuStats
+}
+
+type OllamaPullProgress struct {
+	Status    string `json:"status"`
+	Digest    string `json:"digest,omitempty"`
+	Total     int64  `json:"total,omitempty"`
+	Completed int64  `json:"completed,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type OllamaShowResponse struct {
+	Parameters string `json:"parameters"`
+}
+
+type OllamaTagsResponse struct {
+	Models []OllamaModel `json:"models"`
+}
+
+type OllamaModel struct {
+	Name       string       `json:"name"`
+	Model      string       `json:"model,omitempty"`
+	ModifiedAt time.Time    `json:"modified_at"`
+	Size       int64        `json:"size"`
+	Digest     string       `json:"digest,omitempty"`
+	Details    ModelDetails `json:"details"`
+	// Backends lists the OLLAMA_BACKENDS that have the model; it is only
+	// filled in when there is more than one backend.
+	Backends []string `json:"backends,omitempty"`
+}
+
+type ModelDetails struct {
+	Format            string   `json:"format,omitempty"`
+	Family            string   `json:"family,omitempty"`
+	Families          []string `json:"families,omitempty"`
+	ParameterSize     string   `json:"parameter_size,omitempty"`
+	QuantizationLevel string   `json:"quantization_level,omitempty"`
+}
+
+type ModelListResponse struct {
+	Models []OllamaModel `json:"models"`
+	Total  int           `json:"total"`
+}
+
+type ServerStatus struct {
+	OllamaURL        string `json:"ollama_url"`
+	Connected        bool   `json:"connected"`
+	PortListening    string `json:"port"`
+	TelemetryHealthy bool   `json:"telemetry_healthy"`
+	OllamaVersion    string `json:"ollama_version,omitempty"`
+	SSEConnections   int64  `json:"sse_connections"`
+	// TokenBudgetRemaining is only reported when HOURLY_TOKEN_BUDGET is set.
+	TokenBudgetRemaining *int `json:"token_budget_remaining,omitempty"`
+}
+
+var upstreamTransport = &http.Transport{
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 10,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+// Each upstream action gets its own timeout; they share one transport so
+// connections are still pooled.
+var (
+	generateClient *http.Client
+	listClient     *http.Client
+	pullClient     *http.Client
+	deleteClient   *http.Client
+)
+
+// shutdownRequested is closed by /api/shutdown to start the same graceful
+// drain that SIGINT/SIGTERM trigger. shuttingDown is closed once the drain
+// starts, to end the streams that otherwise last as long as the client stays.
+var (
+	shutdownRequested = make(chan struct{})
+	shutdownOnce      sync.Once
+	shuttingDown      = make(chan struct{})
+)
+
+func main() {
+	selfCheck := flag.Bool("selfcheck", false, "check Ollama connectivity, models and a tiny generation, then exit")
+	flag.Parse()
+	if problems := validateConfig(); len(problems) > 0 {
+		log.Fatalf("Invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+	if *selfCheck {
+		os.Exit(runSelfCheck())
+	}
+
+	log.Printf("Web UI: http://localhost:%s", port)
+	if configFile != "" {
+		log.Printf("Config file: %s (environment overrides it)", configFile)
+	}
+	log.Printf("Ollama API: %s", redactURL(ollamaBaseURL))
+	log.Printf("Config: port=%s timeouts(generate=%s list=%s pull=%s delete=%s) max_concurrent_pulls=%d hourly_token_budget=%d health=%s/%d (full settings at /api/config)",
+		port, generateTimeout, listTimeout, pullTimeout, deleteTimeout, cap(pullSlots), hourlyTokenBudget, healthInterval, healthThreshold)
+
+	stopExporter := func() {}
+	if otlpEndpoint != "" {
+		stop, done := make(chan struct{}), make(chan struct{})
+		go runSpanExporter(stop, done)
+		stopExporter = func() { close(stop); <-done }
+		log.Printf("Tracing: exporting spans to %s", otlpEndpoint)
+	}
+
+	if modelUsagePath != "" {
+		if err := modelUsage.load(modelUsagePath); err != nil {
+			log.Printf("Model usage %s: %v (starting empty)", modelUsagePath, err)
+		}
+	}
+	// Known before the first request, so version-gated fields are right
+	// from the start; runHealthCheck checks again after each reconnect.
+	detectOllamaVersion()
+	go runHealthCheck(healthInterval, healthThreshold)
+	go watchUpstream(eventsPollInterval)
+	go expireBrowserSessions()
+	gpu = &arcProvider{cardPath: gpuCardPath}
+	go runTelemetry(context.Background(), gpu, telemetryInterval)
+	if len(keepWarmModels) > 0 {
+		go runKeepWarm(keepWarmModels, keepWarmInterval, keepWarmKeepAlive)
+		log.Printf("Keep-warm: %s every %s (keep_alive %s)", strings.Join(keepWarmModels, ", "), keepWarmInterval, keepWarmKeepAlive)
+	}
+
+	srv := &http.Server{Addr: ":" + port, Handler: newHandler()}
+	srv.RegisterOnShutdown(func() { close(shuttingDown) })
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-stop:
+		log.Printf("Received %s, draining in-flight requests", sig)
+	case <-shutdownRequested:
+		log.Printf("Remote shutdown requested, draining in-flight requests")
+	}
+
+	// In-flight streams get up to the generate timeout to finish.
+	ctx, cancel := context.WithTimeout(context.Background(), generateTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %v", err)
+	}
+	stopExporter()
+	modelUsage.save()
+	log.Printf("Server stopped")
+}
+
+// newHandler registers every route and wraps them in the middleware.
+func newHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", serveHTML)
+	mux.HandleFunc("/api/ollama-action", withAllow(handleOllamaAction, http.MethodPost))
+	mux.HandleFunc("/api/models", withAllow(handleListModels, http.MethodGet))
+	mux.HandleFunc("/api/status", withAllow(handleServerStatus, http.MethodGet))
+	mux.HandleFunc("/api/shutdown", withAllow(handleShutdown, http.MethodPost))
+	mux.HandleFunc("/api/session/{id}/stream", withAllow(handleSessionStream, http.MethodGet))
+	mux.HandleFunc("/api/disk", withAllow(handleDiskUsage, http.MethodGet))
+	mux.HandleFunc("/api/events", withAllow(handleEvents, http.MethodGet))
+	mux.HandleFunc("/api/test-all", withAllow(handleTestAll, http.MethodPost))
+	mux.HandleFunc("/api/session", withAllow(handleSession, http.MethodGet))
+	mux.HandleFunc("/api/models/pull-and-run", withAllow(handlePullAndRun, http.MethodPost))
+	mux.HandleFunc("/api/gpu", withAllow(handleGPU, http.MethodGet))
+	mux.HandleFunc("/api/modelfile/validate", withAllow(handleValidateModelfile, http.MethodPost))
+	mux.HandleFunc("/api/benchmark", withAllow(handleBenchmark, http.MethodPost))
+	mux.HandleFunc("/api/complete", withAllow(handleComplete, http.MethodGet))
+	mux.HandleFunc("/api/models/details", withAllow(handleModelDetails, http.MethodPost))
+	mux.HandleFunc("/api/models/rename", withAllow(handleRenameModel, http.MethodPost))
+	mux.HandleFunc("/api/models/fit", withAllow(handleModelFit, http.MethodGet))
+	mux.HandleFunc("/api/dashboard/stream", withAllow(handleDashboardStream, http.MethodGet))
+	mux.HandleFunc("/api/stats/models", withAllow(handleModelStats, http.MethodGet))
+	mux.HandleFunc("/api/requests/{id}", withAllow(handleDeleteRequest, http.MethodDelete))
+	mux.HandleFunc("/api/estimate", withAllow(handleEstimate, http.MethodPost))
+	mux.HandleFunc("/api/gpu/reset", withAllow(handleGPUReset, http.MethodPost))
+	mux.HandleFunc("/api/ollama-logs", withAllow(handleOllamaLogs, http.MethodGet))
+	mux.HandleFunc("/api/quota", withAllow(handleQuota, http.MethodGet))
+	mux.HandleFunc("/api/config", withAllow(handleConfig, http.MethodGet))
+	mux.HandleFunc("/api/pull/cancel", withAllow(handlePullCancel, http.MethodPost))
+	mux.HandleFunc("/api/models/usage", withAllow(handleModelUsage, http.MethodGet))
+	mux.HandleFunc("/api/models/running", withAllow(handleRunningModels, http.MethodGet))
+	mux.HandleFunc("/api/webhook", withAllow(handleWebhook, http.MethodPost))
+	mux.HandleFunc("/api/cancel", withAllow(handleCancelRequest, http.MethodGet, http.MethodPost))
+	return withCORS(withTracing(withDeadline(withSessions(mux))))
+}
+
+// runSelfCheck verifies Ollama connectivity, lists models and runs a tiny
+// generation against the first one, printing a pass/fail report. It returns
+// the process exit code.
+func runSelfCheck() int {
+	fmt.Printf("Self-check against %s\n", ollamaBaseURL)
+
+	step := func(name string, fn func() (string, error)) bool {
+		start := time.Now()
+		detail, err := fn()
+		elapsed := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			fmt.Printf("  FAIL  %-12s %8s  %v\n", name, elapsed, err)
+			return false
+		}
+		fmt.Printf("  PASS  %-12s %8s  %s\n", name, elapsed, detail)
+		return true
+	}
+
+	client := &http.Client{Timeout: generateTimeout}
+	var tags OllamaTagsResponse
+
+	ok := step("connectivity", func() (string, error) {
+		req, _ := newUpstreamRequest(context.Background(), http.MethodGet, ollamaTagsAPI, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+			return "", fmt.Errorf("decode tags: %w", err)
+		}
+		return "reachable", nil
+	})
+
+	ok = ok && step("list models", func() (string, error) {
+		if len(tags.Models) == 0 {
+			return "", fmt.Errorf("no models installed")
+		}
+		return fmt.Sprintf("%d installed", len(tags.Models)), nil
+	})
+
+	ok = ok && step("generate", func() (string, error) {
+		model := tags.Models[0].Name
+		data, _ := json.Marshal(OllamaGenerateRequestPayload{
+			Model:   model,
+			Prompt:  "Reply with the single word: ok",
+			Options: map[string]interface{}{"num_predict": 8},
+		})
+		req, _ := newUpstreamRequest(context.Background(), http.MethodPost, ollamaGenerateAPI, bytes.NewReader(data))
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			return "", fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+		}
+		var chunk OllamaResponseChunk
+		if err := json.NewDecoder(resp.Body).Decode(&chunk); err != nil {
+			return "", fmt.Errorf("decode response: %w", err)
+		}
+		if chunk.Error != "" {
+			return "", fmt.Errorf("%s", chunk.Error)
+		}
+		return fmt.Sprintf("%s answered %q", model, strings.TrimSpace(chunk.Response)), nil
+	})
+
+	if !ok {
+		fmt.Println("Self-check FAILED")
+		return 1
+	}
+	fmt.Println("Self-check passed")
+	return 0
+}
+
+// withCORS applies CORS_ALLOW_ORIGINS. "*" allows any origin without
+// credentials; otherwise the request Origin is echoed back only when listed,
+// with credentials allowed. Disallowed origins get no CORS headers at all.
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := false
+		if origin != "" {
+			for _, o := range corsAllowOrigins {
+				if o == "*" {
+					w.Header().Set("Access-Control-Allow-Origin", "*")
+					allowed = true
+					break
+				}
+				if o == origin {
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+					w.Header().Add("Vary", "Origin")
+					allowed = true
+					break
+				}
+			}
+		}
+
+		if allowed && r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-ID, X-Request-Deadline")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withDeadline applies a client's X-Request-Deadline, either an RFC 3339
+// time or a number of seconds from now, as the request context's deadline,
+// so upstream calls made for it are cancelled in time. It is capped at
+// MAX_REQUEST_DEADLINE_SEC; a deadline already past is refused outright.
+func withDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("X-Request-Deadline")
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+		deadline, err := parseDeadline(header, now)
+		if err != nil {
+			http.Error(w, "Invalid X-Request-Deadline: want an RFC 3339 time or seconds", http.StatusBadRequest)
+			return
+		}
+		if !deadline.After(now) {
+			http.Error(w, "X-Request-Deadline has already passed", http.StatusGatewayTimeout)
+			return
+		}
+		if limit := now.Add(maxRequestDeadline); deadline.After(limit) {
+			deadline = limit
+		}
+
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func parseDeadline(v string, now time.Time) (time.Time, error) {
+	if sec, err := strconv.ParseFloat(v, 64); err == nil {
+		if math.IsNaN(sec) || math.IsInf(sec, 0) {
+			return time.Time{}, fmt.Errorf("invalid seconds %q", v)
+		}
+		return now.Add(time.Duration(sec * float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// withAllow answers OPTIONS on a route with 204 and an Allow header listing
+// its methods, and rejects any other unsupported method with 405 and the
+// same header. CORS preflights never get here; withCORS answers them first.
+func withAllow(h http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(append(methods, http.MethodOptions), ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Allow", allow)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !slices.Contains(methods, r.Method) {
+			w.Header().Set("Allow", allow)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+const (
+	sessionCookieName   = "webolla_session"
+	sessionHistoryLimit = 100
+)
+
+// browserSession is per-browser server-side state, identified by an
+// HMAC-signed cookie. No login is involved.
+type browserSession struct {
+	ID string
+
+	mu            sync.Mutex
+	history       []Message
+	conversations map[string]*conversation
+	lastSeen      time.Time
+}
+
+// conversation is a named chat whose history is kept server-side. busy is
+// held for a whole turn, so turns on one conversation never interleave,
+// while other conversations in the session go ahead in parallel.
+type conversation struct {
+	busy sync.Mutex
+
+	mu       sync.Mutex
+	messages []Message
+}
+
+type browserSessionKey struct{}
+
+var browserSessions = struct {
+	sync.Mutex
+	m map[string]*browserSession
+}{m: make(map[string]*browserSession)}
+
+func signSessionID(id string) string {
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte(id))
+	return id + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySessionCookie returns the session ID if the cookie's signature is valid.
+func verifySessionCookie(value string) (string, bool) {
+	id, _, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(signSessionID(id)), []byte(value)) {
+		return "", false
+	}
+	return id, true
+}
+
+// sessionSlot is what withSessions puts in the request context: the
+// caller's session if its cookie named a live one, and what is needed to
+// issue one if a handler asks for it.
+type sessionSlot struct {
+	s      *browserSession
+	w      http.ResponseWriter
+	secure bool
+}
+
+// withSessions attaches the caller's browserSession to the request context
+// when the request has a valid cookie for one. It creates none: API clients,
+// webhooks and EventSource reconnects don't need one, so only handlers that
+// do call ensureBrowserSession.
+func withSessions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slot := &sessionSlot{w: w, secure: r.TLS != nil}
+		if c, err := r.Cookie(sessionCookieName); err == nil {
+			if id, ok := verifySessionCookie(c.Value); ok {
+				browserSessions.Lock()
+				slot.s = browserSessions.m[id]
+				browserSessions.Unlock()
+			}
+		}
+		if s := slot.s; s != nil {
+			s.mu.Lock()
+			s.lastSeen = time.Now()
+			s.mu.Unlock()
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), browserSessionKey{}, slot)))
+	})
+}
+
+// browserSessionFromContext returns the caller's session, or nil if it has
+// none yet.
+func browserSessionFromContext(ctx context.Context) *browserSession {
+	if slot, _ := ctx.Value(browserSessionKey{}).(*sessionSlot); slot != nil {
+		return slot.s
+	}
+	return nil
+}
+
+// ensureBrowserSession returns the caller's session, starting one and
+// setting its signed cookie if it has none (or an invalid or expired one).
+// Call it before writing the response.
+func ensureBrowserSession(ctx context.Context) *browserSession {
+	slot, _ := ctx.Value(browserSessionKey{}).(*sessionSlot)
+	if slot == nil {
+		return nil
+	}
+	if slot.s != nil {
+		return slot.s
+	}
+
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	s := &browserSession{ID: hex.EncodeToString(buf), lastSeen: time.Now()}
+	browserSessions.Lock()
+	browserSessions.m[s.ID] = s
+	browserSessions.Unlock()
+	http.SetCookie(slot.w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    signSessionID(s.ID),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   slot.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	slot.s = s
+	return s
+}
+
+// recordChat stores the latest conversation, keeping the most recent
+// sessionHistoryLimit messages.
+func (s *browserSession) recordChat(messages []Message, reply string) {
+	if s == nil {
+		return
+	}
+	history := withReply(messages, reply)
+
+	s.mu.Lock()
+	s.history = history
+	s.mu.Unlock()
+}
+
+// withReply appends the assistant's reply to a copy of messages, keeping
+// the most recent sessionHistoryLimit.
+func withReply(messages []Message, reply string) []Message {
+	history := append(append([]Message(nil), messages...), Message{Role: "assistant", Content: reply})
+	if len(history) > sessionHistoryLimit {
+		history = history[len(history)-sessionHistoryLimit:]
+	}
+	return history
+}
+
+// conversation returns the session's conversation with the given ID,
+// starting an empty one if there is none yet.
+func (s *browserSession) conversation(id string) *conversation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conversations == nil {
+		s.conversations = make(map[string]*conversation)
+	}
+	c, ok := s.conversations[id]
+	if !ok {
+		c = &conversation{}
+		s.conversations[id] = c
+	}
+	return c
+}
+
+func (c *conversation) history() []Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.messages)
+}
+
+// record replaces the history with a finished turn: the full message list
+// sent to the model and its reply.
+func (c *conversation) record(messages []Message, reply string) {
+	history := withReply(messages, reply)
+	c.mu.Lock()
+	c.messages = history
+	c.mu.Unlock()
+}
+
+// expireBrowserSessions drops sessions idle for longer than SESSION_IDLE_MIN.
+func expireBrowserSessions() {
+	for range time.Tick(time.Minute) {
+		browserSessions.Lock()
+		for id, s := range browserSessions.m {
+			s.mu.Lock()
+			idle := time.Since(s.lastSeen)
+			s.mu.Unlock()
+			if idle > sessionIdleTimeout {
+				delete(browserSessions.m, id)
+			}
+		}
+		browserSessions.Unlock()
+	}
+}
+
+func handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s := ensureBrowserSession(r.Context())
+	s.mu.Lock()
+	conversations := make(map[string]*conversation, len(s.conversations))
+	maps.Copy(conversations, s.conversations)
+	resp := map[string]interface{}{
+		"id":        s.ID,
+		"history":   s.history,
+		"last_seen": s.lastSeen,
+	}
+	s.mu.Unlock()
+
+	histories := make(map[string][]Message, len(conversations))
+	for id, c := range conversations {
+		histories[id] = c.history()
+	}
+	resp["conversations"] = histories
+	if chatWelcomeMessage != "" {
+		resp["welcome"] = Message{Role: "assistant", Content: chatWelcomeMessage, DisplayOnly: true}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// authorized reports whether the request carries the configured API_TOKEN as
+// a bearer token. With no token configured nothing is authorized.
+func authorized(r *http.Request) bool {
+	if apiToken == "" {
+		return false
+	}
+	got := []byte(r.Header.Get("Authorization"))
+	return subtle.ConstantTimeCompare(got, []byte("Bearer "+apiToken)) == 1
+}
+
+// requireToken answers 403 when no API_TOKEN is configured, since the
+// endpoint is then off, and 401 when the request doesn't carry it. It
+// reports whether the handler may go on.
+func requireToken(w http.ResponseWriter, r *http.Request) bool {
+	if apiToken == "" {
+		http.Error(w, "Forbidden: set API_TOKEN to enable this endpoint", http.StatusForbidden)
+		return false
+	}
+	if !authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func handleShutdown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !allowRemoteShutdown {
+		http.Error(w, "Remote shutdown is disabled", http.StatusForbidden)
+		return
+	}
+	if !requireToken(w, r) {
+		return
+	}
+
+	log.Printf("Shutdown triggered by %s (request id %q)", r.RemoteAddr, r.Header.Get("X-Request-ID"))
+	w.WriteHeader(http.StatusAccepted)
+
+	shutdownOnce.Do(func() { close(shutdownRequested) })
+}
+
+// allActions are the ClientRequest action types, all enabled unless
+// ENABLED_ACTIONS lists a subset.
+var allActions = []string{"generate", "chat", "pull", "delete", "copy", "show"}
+
+// actionAllowed answers 403 and returns false when ENABLED_ACTIONS turns
+// action off.
+func actionAllowed(w http.ResponseWriter, action string) bool {
+	if enabledActions[action] {
+		return true
+	}
+	http.Error(w, fmt.Sprintf("The %s action is disabled on this server", action), http.StatusForbidden)
+	return false
+}
+
+// serveHTML injects the enabled actions so the page can hide tabs for the
+// ones the server would refuse.
+func serveHTML(w http.ResponseWriter, _ *http.Request) {
+	enabled := slices.DeleteFunc(slices.Clone(allActions), func(a string) bool { return !enabledActions[a] })
+	list, _ := json.Marshal(enabled)
+	script := fmt.Sprintf("<script>window.WEBOLLA_ENABLED_ACTIONS = %s;</script>\n</head>", list)
+
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprint(w, strings.Replace(htmlContent, "</head>", script, 1))
+}
+
+// serverStarted is reported as uptime on the dashboard stream.
+var serverStarted = time.Now()
+
+// activeGenerations counts generate and chat requests in progress.
+var activeGenerations atomic.Int64
+
+func handleServerStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(currentServerStatus())
+}
+
+func currentServerStatus() ServerStatus {
+	status := ServerStatus{
+		OllamaURL:        ollamaBaseURL,
+		Connected:        health.isConnected(),
+		PortListening:    port,
+		TelemetryHealthy: telemetryHealthy(),
+		OllamaVersion:    detectedOllamaVersion(),
+		SSEConnections:   sseConnections.Load(),
+	}
+	if hourlyTokenBudget > 0 {
+		remaining := tokenBudget.remaining(time.Now())
+		status.TokenBudgetRemaining = &remaining
+	}
+	return status
+}
+
+// ModelMetrics is the per-model usage served by /api/stats/models.
+type ModelMetrics struct {
+	Requests        int64   `json:"requests"`
+	Errors          int64   `json:"errors"`
+	TotalTokens     int64   `json:"total_tokens"`
+	AvgTokensPerSec float64 `json:"avg_tokens_per_sec"`
+	evalNanos       int64
+}
+
+type modelMetricsState struct {
+	sync.Mutex
+	m map[string]*ModelMetrics
+}
+
+var modelMetrics = modelMetricsState{m: make(map[string]*ModelMetrics)}
+
+// unknownModelStats collects the failures of models that have no entry and
+// aren't installed, so made-up names can't grow the stats without bound.
+const unknownModelStats = "(unknown)"
+
+// record counts one generate or chat request. The average rate is total
+// tokens over total eval time, so long generations weigh more than short ones.
+// A failure for a model with no entry yet may be for a name that doesn't
+// exist, so it only gets one if the model list watchUpstream last fetched
+// has it; otherwise it counts under unknownModelStats.
+func (s *modelMetricsState) record(model string, tokens int, evalDuration int64, failed bool) {
+	model = fullModelName(model)
+	s.Lock()
+	_, known := s.m[model]
+	s.Unlock()
+	if !known && failed && !modelInstalled(model) {
+		model = unknownModelStats
+	}
+	s.add(model, tokens, evalDuration, failed)
+}
+
+func (s *modelMetricsState) add(model string, tokens int, evalDuration int64, failed bool) {
+	s.Lock()
+	defer s.Unlock()
+	m, ok := s.m[model]
+	if !ok {
+		m = &ModelMetrics{}
+		s.m[model] = m
+	}
+	m.Requests++
+	if failed {
+		m.Errors++
+	}
+	m.TotalTokens += int64(tokens)
+	m.evalNanos += evalDuration
+	if m.evalNanos > 0 {
+		m.AvgTokensPerSec = float64(m.TotalTokens) / time.Duration(m.evalNanos).Seconds()
+	}
+}
+
+func (s *modelMetricsState) snapshot() map[string]ModelMetrics {
+	s.Lock()
+	defer s.Unlock()
+	out := make(map[string]ModelMetrics, len(s.m))
+	for model, m := range s.m {
+		out[model] = *m
+	}
+	return out
+}
+
+func handleModelStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(modelMetrics.snapshot())
+}
+
+// modelUsage remembers when each model was last used for a generate or
+// chat that succeeded. With MODEL_USAGE_PATH set it is also kept there, so
+// it survives restarts.
+type modelUsageState struct {
+	sync.Mutex
+	lastUsed map[string]time.Time
+	path     string
+	// saving is set while a save is scheduled.
+	saving bool
+}
+
+// modelUsageSaveDelay batches the saves of a burst of requests into one.
+const modelUsageSaveDelay = 5 * time.Second
+
+var modelUsage = modelUsageState{lastUsed: make(map[string]time.Time)}
+
+// load reads the saved timestamps. A missing file is a fresh start.
+func (s *modelUsageState) load(path string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &s.lastUsed)
+}
+
+// touch records a use of model now. The file is saved modelUsageSaveDelay
+// later, with whatever else was used in the meantime.
+func (s *modelUsageState) touch(model string) {
+	s.Lock()
+	defer s.Unlock()
+	s.lastUsed[fullModelName(model)] = time.Now().UTC()
+	if s.path != "" && !s.saving {
+		s.saving = true
+		time.AfterFunc(modelUsageSaveDelay, s.save)
+	}
+}
+
+// save writes the file, replacing it by rename so a crash mid-write can't
+// leave it truncated.
+func (s *modelUsageState) save() {
+	s.Lock()
+	defer s.Unlock()
+	s.saving = false
+	if s.path == "" {
+		return
+	}
+
+	data, _ := json.MarshalIndent(s.lastUsed, "", "  ")
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		log.Printf("Saving model usage: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		log.Printf("Saving model usage: %v", err)
+	}
+}
+
+func (s *modelUsageState) get(model string) (time.Time, bool) {
+	s.Lock()
+	defer s.Unlock()
+	t, ok := s.lastUsed[model]
+	return t, ok
+}
+
+// ModelUsage is one entry of /api/models/usage.
+type ModelUsage struct {
+	Name     string     `json:"name"`
+	Size     int64      `json:"size"`
+	LastUsed *time.Time `json:"last_used"`
+}
+
+// handleRunningModels lists the models Ollama has loaded, with how long
+// each has left before it is unloaded.
+func handleRunningModels(w http.ResponseWriter, r *http.Request) {
+	running, err := fetchRunning(r.Context())
+	if err != nil {
+		writeUpstreamJSONError(w, err)
+		return
+	}
+	if running == nil {
+		running = []RunningModel{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"models": running})
+}
+
+// handleModelUsage lists installed models with when each was last used,
+// least recently used first and, among those never used, largest first:
+// the top of the list is what to prune.
+func handleModelUsage(w http.ResponseWriter, r *http.Request) {
+	tags, err := fetchTags(r.Context())
+	if err != nil {
+		writeUpstreamJSONError(w, err)
+		return
+	}
+
+	usage := make([]ModelUsage, 0, len(tags.Models))
+	for _, m := range tags.Models {
+		u := ModelUsage{Name: m.Name, Size: m.Size}
+		if t, ok := modelUsage.get(m.Name); ok {
+			u.LastUsed = &t
+		}
+		usage = append(usage, u)
+	}
+	slices.SortStableFunc(usage, func(a, b ModelUsage) int {
+		switch {
+		case a.LastUsed == nil && b.LastUsed == nil:
+			return cmp.Compare(b.Size, a.Size)
+		case a.LastUsed == nil:
+			return -1
+		case b.LastUsed == nil:
+			return 1
+		}
+		return a.LastUsed.Compare(*b.LastUsed)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(usage)
+}
+
+// DashboardEvent is one tick of /api/dashboard/stream.
+type DashboardEvent struct {
+	Type      string          `json:"type"`
+	Server    ServerStatus    `json:"server"`
+	GPU       GpuStats        `json:"gpu"`
+	Requests  DashboardCounts `json:"requests"`
+	UptimeSec int64           `json:"uptime_sec"`
+}
+
+type DashboardCounts struct {
+	ActiveGenerations int64 `json:"active_generations"`
+	ActivePulls       int   `json:"active_pulls"`
+}
+
+// dashboardIntervals are the tick rates /api/dashboard/stream accepts as
+// ?mode=.
+var dashboardIntervals = map[string]time.Duration{
+	"fast":   250 * time.Millisecond,
+	"normal": time.Second,
+	"slow":   5 * time.Second,
+}
+
+func handleDashboardStream(w http.ResponseWriter, r *http.Request) {
+	interval, ok := dashboardIntervals[cmp.Or(r.URL.Query().Get("mode"), "normal")]
+	if !ok {
+		http.Error(w, "mode must be fast, normal or slow", http.StatusBadRequest)
+		return
+	}
+	if !acquireSSE(w) {
+		return
+	}
+	defer releaseSSE()
+	sse := newSSEWriter(w)
+	ctx, cancel := streamContext(r)
+	defer cancel()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		sse.emit(DashboardEvent{
+			Type:   "dashboard",
+			Server: currentServerStatus(),
+			GPU:    getArcStats(),
+			Requests: DashboardCounts{
+				ActiveGenerations: activeGenerations.Load(),
+				ActivePulls:       len(pullSlots),
+			},
+			UptimeSec: int64(time.Since(serverStarted).Seconds()),
+		})
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func handleOllamaAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ClientRequest
+	if err := decodeClientRequest(r.Body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	span := spanFromContext(r.Context())
+	span.setAttr("webolla.action", req.ActionType)
+	span.setAttr("webolla.model", req.Model)
+
+	if slices.Contains(allActions, req.ActionType) && !actionAllowed(w, req.ActionType) {
+		return
+	}
+
+	if req.ActionType == "generate" || req.ActionType == "chat" {
+		if reset, ok := tokenBudget.allow(time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+			http.Error(w, "Hourly token budget exhausted", http.StatusTooManyRequests)
+			return
+		}
+		if reset, ok := clientQuota(r).allow(time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+			http.Error(w, "Your token quota is used up", http.StatusTooManyRequests)
+			return
+		}
+		if loadRetryAfter > 0 && modelLoading(r.Context(), req.Model) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(loadRetryAfter.Seconds())))
+			http.Error(w, fmt.Sprintf("%s is still loading, try again shortly", req.Model), http.StatusServiceUnavailable)
+			return
+		}
+		activeGenerations.Add(1)
+		defer activeGenerations.Add(-1)
+	}
+
+	switch req.ActionType {
+	case "generate":
+		streamGenerate(w, r, req)
+	case "chat":
+		streamChat(w, r, req)
+	case "pull":
+		if !acquirePullSlot(w, r) {
+			return
+		}
+		defer func() { <-pullSlots }()
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		defer trackPull(req.Model, cancel)()
+		streamPull(w, r.WithContext(ctx), req.Model)
+	case "delete":
+		modelAction(w, r, deleteClient, http.MethodDelete, ollamaDeleteAPI, req.Model)
+	case "show":
+		showAction(w, r, req.Model)
+	case "copy":
+		copyAction(w, r, req.Model, req.Destination)
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+	}
+}
+
+// webhookMaxBody caps a webhook request, which is read whole to check its
+// signature before anything else happens.
+const webhookMaxBody = 32 << 20
+
+// handleWebhook runs an /api/ollama-action request sent by another server,
+// e.g. CI posting a prompt. It is authenticated by X-Signature: the hex
+// HMAC-SHA256 of the raw body keyed with WEBHOOK_SECRET, optionally prefixed
+// "sha256=" the way GitHub sends it.
+func handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if len(webhookSecret) == 0 {
+		http.Error(w, "Webhooks are not enabled on this server", http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, webhookMaxBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !validSignature(body, r.Header.Get("X-Signature")) {
+		log.Printf("Webhook from %s rejected: bad signature", r.RemoteAddr)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	handleOllamaAction(w, r)
+}
+
+func validSignature(body []byte, signature string) bool {
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil || len(got) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, webhookSecret)
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), got)
+}
+
+// decodeClientRequest decodes a ClientRequest, first renaming any
+// FIELD_ALIASES keys to their canonical names. Canonical keys win when a
+// request carries both.
+func decodeClientRequest(body io.Reader, req *ClientRequest) error {
+	if len(fieldAliases) == 0 {
+		return json.NewDecoder(body).Decode(req)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(body).Decode(&fields); err != nil {
+		return err
+	}
+	for alias, canonical := range fieldAliases {
+		value, ok := fields[alias]
+		if !ok {
+			continue
+		}
+		delete(fields, alias)
+		if _, exists := fields[canonical]; !exists {
+			fields[canonical] = value
+		}
+	}
+
+	data, _ := json.Marshal(fields)
+	return json.Unmarshal(data, req)
+}
+
+// generatePrompt is the data GENERATE_TEMPLATE is executed with.
+type generatePrompt struct {
+	Prompt string
+}
+
+// parseGenerateTemplate parses GENERATE_TEMPLATE and runs it once, so a
+// reference to anything but {{.Prompt}} fails at startup, not per request.
+func parseGenerateTemplate(text string) (*template.Template, error) {
+	t, err := template.New("GENERATE_TEMPLATE").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Execute(io.Discard, generatePrompt{}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func streamGenerate(w http.ResponseWriter, r *http.Request, req ClientRequest) {
+	if strings.TrimSpace(req.Prompt) == "" && len(req.Images) == 0 && !req.AllowEmptyPrompt {
+		http.Error(w, "prompt is empty", http.StatusBadRequest)
+		return
+	}
+	images := make([]string, len(req.Images))
+	for i, img := range req.Images {
+		raw, err := normalizeImage(img)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("image %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		images[i] = raw
+	}
+
+	keepAlive, err := req.keepAlive()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prompt := req.Prompt
+	if generateTemplate != nil {
+		var b strings.Builder
+		if err := generateTemplate.Execute(&b, generatePrompt{Prompt: prompt}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		prompt = b.String()
+	}
+
+	payload := OllamaGenerateRequestPayload{
+		Model:   req.Model,
+		Prompt:  prompt,
+		Stream:  true,
+		Options: buildOptions(r.Context(), req.Model, req.Params),
+		Context: req.Context,
+		Think:   req.think(),
+		Images:  images,
+
+		KeepAlive: keepAlive,
+	}
+
+	if syncRequested(r, req) {
+		payload.Stream = false
+		respondSync(w, r, ollamaGenerateAPI, req, payload)
+		return
+	}
+	streamOllama(w, r, ollamaGenerateAPI, payload, req, true)
+}
+
+// keepAlive returns the request's keep_alive for Ollama. A bare number is
+// taken as seconds, as Ollama does for a JSON number; Ollama rejects it as
+// a string, so it gets an "s".
+func (req ClientRequest) keepAlive() (string, error) {
+	v := strings.TrimSpace(req.KeepAlive)
+	if v == "" {
+		return "", nil
+	}
+	if _, err := strconv.Atoi(v); err == nil {
+		v += "s"
+	}
+	if _, err := time.ParseDuration(v); err != nil {
+		return "", fmt.Errorf("invalid keepAlive %q: use a duration like 5m, 0, or -1", req.KeepAlive)
+	}
+	return v, nil
+}
+
+// buildOptions maps the client's generation params to Ollama options. Unless
+// the client sets its own stop sequences, the model's recommended ones from
+// /api/show are applied.
+func buildOptions(ctx context.Context, model string, p GenerationParams) map[string]interface{} {
+	opts := map[string]interface{}{
+		"temperature":    p.Temperature,
+		"top_p":          p.TopP,
+		"top_k":          p.TopK,
+		"repeat_penalty": p.RepeatPenalty,
+		"num_predict":    p.NumPredict,
+	}
+
+	stop := p.Stop
+	if len(stop) == 0 {
+		stop = modelStopTokens(ctx, model)
+	}
+	if len(stop) > 0 {
+		opts["stop"] = stop
+	}
+
+	// Only sent when asked for and understood; without logprobs support
+	// the field is simply absent from the response.
+	if ollamaSupports("logprobs") {
+		if p.Logprobs {
+			opts["logprobs"] = true
+		}
+		if p.TopLogprobs > 0 {
+			opts["top_logprobs"] = p.TopLogprobs
+		}
+	}
+	return opts
+}
+
+var modelStops = struct {
+	sync.Mutex
+	m map[string][]string
+}{m: make(map[string][]string)}
+
+// modelStopTokens returns the stop parameters declared in the model's
+// Modelfile, caching them per model. Lookup failures are not cached.
+func modelStopTokens(ctx context.Context, model string) []string {
+	modelStops.Lock()
+	stop, ok := modelStops.m[model]
+	modelStops.Unlock()
+	if ok {
+		return stop
+	}
+
+	show, err := fetchModelShow(ctx, model)
+	if err != nil {
+		log.Printf("Stop token lookup for %s: %v", model, err)
+		return nil
+	}
+	stop = parseStopParameters(show.Parameters)
+
+	modelStops.Lock()
+	modelStops.m[model] = stop
+	modelStops.Unlock()
+	return stop
+}
+
+func fetchModelShow(ctx context.Context, model string) (*OllamaShowResponse, error) {
+	var show OllamaShowResponse
+	if err := showModel(ctx, model, &show); err != nil {
+		return nil, err
+	}
+	return &show, nil
+}
+
+// showModel calls /api/show for model and decodes the reply into v.
+func showModel(ctx context.Context, model string, v interface{}) error {
+	data, _ := json.Marshal(OllamaModelActionPayload{Model: model})
+	req, _ := newUpstreamRequest(ctx, http.MethodPost, ollamaShowAPI, bytes.NewReader(data))
+
+	resp, err := listClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var body struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&body) == nil && body.Error != "" {
+			return fmt.Errorf("show returned %s: %s", resp.Status, body.Error)
+		}
+		return fmt.Errorf("show returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// showAction relays Ollama's /api/show for one model. An unknown model
+// keeps Ollama's 404 rather than becoming a 502, so clients can tell a typo
+// from an outage.
+func showAction(w http.ResponseWriter, r *http.Request, model string) {
+	if model == "" {
+		writeJSONError(w, http.StatusBadRequest, "A model name is required", "")
+		return
+	}
+
+	ctx, span := startSpan(r.Context(), "ollama show", spanKindClient)
+	defer span.end()
+	span.setAttr("webolla.model", model)
+
+	data, _ := json.Marshal(OllamaModelActionPayload{Model: model})
+	req, _ := newUpstreamRequest(ctx, http.MethodPost, ollamaShowAPI, bytes.NewReader(data))
+	resp, err := listClient.Do(req)
+	if err != nil {
+		writeUpstreamJSONError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNotFound:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	default:
+		var body struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("show returned %s", resp.Status), body.Error)
+	}
+}
+
+const (
+	modelDetailsMaxNames    = 50
+	modelDetailsParallelism = 4
+)
+
+type ModelDetailsResponse struct {
+	Models map[string]json.RawMessage `json:"models"`
+	Errors map[string]string          `json:"errors,omitempty"`
+}
+
+// handleModelDetails returns /api/show for several models in one round
+// trip, a few at a time. Models that fail are listed under errors instead.
+func handleModelDetails(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Models []string `json:"models"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Models) > modelDetailsMaxNames {
+		http.Error(w, fmt.Sprintf("at most %d models per request", modelDetailsMaxNames), http.StatusBadRequest)
+		return
+	}
+
+	out := ModelDetailsResponse{Models: make(map[string]json.RawMessage), Errors: make(map[string]string)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, modelDetailsParallelism)
+	for _, name := range slices.Compact(slices.Sorted(slices.Values(req.Models))) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			var show json.RawMessage
+			err := showModel(r.Context(), name, &show)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				out.Errors[name] = err.Error()
+				return
+			}
+			out.Models[name] = show
+		}()
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// parseStopParameters extracts the values of "stop" lines from the
+// parameters block of /api/show, e.g. `stop "<|im_end|>"`.
+func parseStopParameters(params string) []string {
+	var stop []string
+	for _, line := range strings.Split(params, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "stop" {
+			continue
+		}
+		value := strings.TrimSpace(strings.TrimSpace(line)[len("stop"):])
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		stop = append(stop, value)
+	}
+	return stop
+}
+
+func streamChat(w http.ResponseWriter, r *http.Request, req ClientRequest) {
+	req.Messages = slices.DeleteFunc(req.Messages, func(m Message) bool { return m.DisplayOnly })
+	if len(req.Tools) > 0 && !ollamaSupports("tools") {
+		http.Error(w, fmt.Sprintf("Ollama %s does not support tools", detectedOllamaVersion()), http.StatusBadRequest)
+		return
+	}
+	if !req.AllowEmptyPrompt && !hasUserContent(req.Messages) {
+		http.Error(w, "last user message is empty", http.StatusBadRequest)
+		return
+	}
+	if req.ConversationID != "" {
+		s := ensureBrowserSession(r.Context())
+		if s == nil {
+			http.Error(w, "conversationId needs a browser session", http.StatusBadRequest)
+			return
+		}
+		req.conv = s.conversation(req.ConversationID)
+		if !req.conv.busy.TryLock() {
+			http.Error(w, "Conversation already has a reply in progress", http.StatusConflict)
+			return
+		}
+		defer req.conv.busy.Unlock()
+		req.Messages = append(req.conv.history(), req.Messages...)
+	}
+	if req.enforceSingleSystem() {
+		req.Messages = singleSystemMessage(req.Messages)
+	}
+	if req.mergeConsecutiveRoles() {
+		req.Messages = mergeConsecutiveRoles(req.Messages)
+	}
+	if err := validateToolMessages(req.Messages); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	messages, err := normalizeImages(req.Messages)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	keepAlive, err := req.keepAlive()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.AssistantPrefix != "" {
+		messages = append(messages, Message{Role: "assistant", Content: req.AssistantPrefix})
+	}
+
+	payload := OllamaChatRequestPayload{
+		Model:    req.Model,
+		Messages: messages,
+		Tools:    req.Tools,
+		Stream:   true,
+		Options:  map[string]interface{}{},
+		Think:    req.think(),
+
+		KeepAlive: keepAlive,
+	}
+
+	if syncRequested(r, req) {
+		payload.Stream = false
+		chunk := respondSync(w, r, ollamaChatAPI, req, payload)
+		if chunk != nil && req.conv != nil {
+			req.conv.record(req.Messages, chunk.content())
+		}
+		return
+	}
+	streamOllama(w, r, ollamaChatAPI, payload, req, false)
+}
+
+// syncRequested reports whether to answer with one complete response rather
+// than SSE: the client asked for stream:false (or left it to a false
+// DEFAULT_STREAM), or it speaks HTTP/1.0, which has no chunked encoding and
+// leaves some clients hanging on a stream.
+func syncRequested(r *http.Request, req ClientRequest) bool {
+	if !r.ProtoAtLeast(1, 1) {
+		log.Printf("%s sent an %s request; replying without streaming", r.RemoteAddr, r.Proto)
+		return true
+	}
+	if req.Stream != nil {
+		return !*req.Stream
+	}
+	return !streamDefault
+}
+
+// respondSync makes a non-streaming call to Ollama and returns the final
+// object as JSON, or just the reply text if the client's Accept header
+// prefers text/plain (handy for shell pipelines) or it is an HTTP/1.0
+// client. Either way X-Response-SHA256 carries the hash of the reply text.
+// Like a stream it can be cancelled by its X-Request-ID, which answers 409.
+// It returns the final chunk, or nil if it answered with an error.
+func respondSync(w http.ResponseWriter, r *http.Request, url string, req ClientRequest, payload interface{}) *OllamaResponseChunk {
+	data, _ := json.Marshal(payload)
+
+	ctx, span := startSpan(r.Context(), "ollama "+req.ActionType, spanKindClient)
+	defer span.end()
+	span.setAttr("webolla.action", req.ActionType)
+	span.setAttr("webolla.model", req.Model)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	httpReq, _ := newUpstreamRequest(ctx, http.MethodPost, url, bytes.NewReader(data))
+
+	// As with a stream, the ID is echoed back so the client can cancel the
+	// request by it.
+	id := cmp.Or(req.RequestID, requestID(r))
+	w.Header().Set("X-Request-ID", id)
+	defer trackRequest(id, cancel)()
+
+	rec := AuditRecord{RequestID: id, Client: r.RemoteAddr, Action: req.ActionType, Model: req.Model}
+	var reply string
+	defer func() { auditGeneration(rec, req, reply) }()
+
+	// stopped answers a request cancelled through the registry, rather than
+	// by the client going away, and reports whether it was.
+	stopped := func() bool {
+		if ctx.Err() == nil || r.Context().Err() != nil {
+			return false
+		}
+		rec.DoneReason = "cancelled"
+		writeJSONError(w, http.StatusConflict, "Request cancelled", "")
+		return true
+	}
+
+	ticket := generations.enter()
+	defer generations.leave(ticket)
+	select {
+	case <-ticket.ready:
+	case <-ctx.Done():
+		stopped()
+		return nil
+	}
+
+	var chunk OllamaResponseChunk
+	failed, cancelled := true, false
+	defer func() {
+		// A cancelled request says nothing about the model.
+		if !cancelled {
+			modelMetrics.record(req.Model, chunk.EvalCount, chunk.EvalDuration, failed)
+		}
+		if !failed {
+			modelUsage.touch(req.Model)
+		}
+	}()
+
+	resp, err := generateClient.Do(httpReq)
+	if err != nil {
+		if cancelled = stopped(); cancelled {
+			return nil
+		}
+		rec.Error = err.Error()
+		writeUpstreamError(w, err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&chunk); err != nil {
+		if cancelled = stopped(); cancelled {
+			return nil
+		}
+		rec.Error = fmt.Sprintf("%s: %v", resp.Status, err)
+		writeUpstreamError(w, fmt.Errorf("%s: %w", resp.Status, err))
+		return nil
+	}
+	if chunk.Error != "" {
+		rec.Error = chunk.Error
+		message, detail := explainUpstreamError(chunk.Error)
+		writeJSONError(w, http.StatusBadGateway, message, detail)
+		return nil
+	}
+	failed = false
+	span.setAttr("webolla.eval_count", chunk.EvalCount)
+	addTokens(r, chunk.EvalCount)
+	if !req.splitThinking() {
+		if thinking := chunk.takeThinking(); thinking != "" {
+			chunk.setContent("<think>" + thinking + "</think>\n\n" + chunk.content())
+		}
+	}
+	// The model only continued the prefix; give the client the complete
+	// text, as streamOllama does.
+	if req.ActionType == "chat" && req.AssistantPrefix != "" {
+		chunk.setContent(req.AssistantPrefix + chunk.content())
+	}
+	if len(contentFilters) > 0 {
+		chunk.setContent(newContentFilter(contentFilters, 0).apply(chunk.content()))
+	}
+
+	reply = chunk.content()
+	rec.DoneReason, rec.EvalCount = chunk.DoneReason, chunk.EvalCount
+	w.Header().Set("X-Response-SHA256", responseSHA256(reply))
+
+	if prefersPlainText(r.Header.Get("Accept")) || !r.ProtoAtLeast(1, 1) {
+		text := chunk.content()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(len(text)))
+		fmt.Fprint(w, text)
+		return &chunk
+	}
+	// Buffered rather than encoded straight out, so a long reply still gets
+	// a Content-Length instead of a chunked body.
+	body, _ := json.Marshal(chunk)
+	body = append(body, '\n')
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+	return &chunk
+}
+
+// prefersPlainText reports whether text/plain comes before application/json
+// in an Accept header. Quality values are ignored; JSON is the default.
+func prefersPlainText(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		switch strings.TrimSpace(mediaType) {
+		case "text/plain":
+			return true
+		case "application/json":
+			return false
+		}
+	}
+	return false
+}
+
+// hasUserContent reports whether the last user message has text or images.
+func hasUserContent(messages []Message) bool {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			return strings.TrimSpace(messages[i].Content) != "" || len(messages[i].Images) > 0
+		}
+	}
+	return false
+}
+
+// mergeConsecutiveRoles joins runs of messages from the same role into one,
+// content separated by newlines. Tool calls and tool results are left
+// alone, since each answers a call of its own.
+func mergeConsecutiveRoles(messages []Message) []Message {
+	merged := make([]Message, 0, len(messages))
+	for _, m := range messages {
+		if n := len(merged); n > 0 && mergeable(merged[n-1], m) {
+			last := &merged[n-1]
+			last.Content += "\n" + m.Content
+			last.Images = append(slices.Clip(last.Images), m.Images...)
+			continue
+		}
+		merged = append(merged, m)
+	}
+	return merged
+}
+
+// singleSystemMessage moves every system message into one at the front,
+// their contents joined in order by blank lines. The rest keep their order.
+func singleSystemMessage(messages []Message) []Message {
+	var system []string
+	rest := make([]Message, 0, len(messages))
+	for _, m := range messages {
+		if m.Role == "system" {
+			system = append(system, m.Content)
+			continue
+		}
+		rest = append(rest, m)
+	}
+	if len(system) == 0 {
+		return messages
+	}
+	return append([]Message{{Role: "system", Content: strings.Join(system, "\n\n")}}, rest...)
+}
+
+func mergeable(a, b Message) bool {
+	return a.Role == b.Role && a.Role != "tool" &&
+		len(a.ToolCalls) == 0 && len(b.ToolCalls) == 0 &&
+		a.Thinking == "" && b.Thinking == ""
+}
+
+// validateToolMessages checks that every tool result answers an earlier
+// assistant tool call: by tool_call_id when given, otherwise any prior call.
+func validateToolMessages(messages []Message) error {
+	calls := make(map[string]bool)
+	sawCall := false
+	for i, m := range messages {
+		switch m.Role {
+		case "assistant":
+			for _, tc := range m.ToolCalls {
+				sawCall = true
+				if tc.ID != "" {
+					calls[tc.ID] = true
+				}
+			}
+		case "tool":
+			if m.ToolCallID != "" && !calls[m.ToolCallID] {
+				return fmt.Errorf("message %d: tool_call_id %q does not match an earlier tool call", i, m.ToolCallID)
+			}
+			if !sawCall {
+				return fmt.Errorf("message %d: tool result without an earlier tool call", i)
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeImages returns a copy of messages with any data URI images
+// reduced to the raw base64 Ollama expects.
+func normalizeImages(messages []Message) ([]Message, error) {
+	out := make([]Message, len(messages))
+	for i, m := range messages {
+		if len(m.Images) > 0 {
+			images := make([]string, len(m.Images))
+			for j, img := range m.Images {
+				raw, err := normalizeImage(img)
+				if err != nil {
+					return nil, fmt.Errorf("message %d image %d: %w", i, j, err)
+				}
+				images[j] = raw
+			}
+			m.Images = images
+		}
+		out[i] = m
+	}
+	return out, nil
+}
+
+// normalizeImage strips a data URI and checks that what is left is valid
+// base64, so a bad image fails here with its index rather than upstream.
+func normalizeImage(img string) (string, error) {
+	raw, err := stripDataURI(img)
+	if err != nil {
+		return "", err
+	}
+	if _, err := base64.StdEncoding.DecodeString(raw); err != nil {
+		return "", fmt.Errorf("not valid base64: %w", err)
+	}
+	return raw, nil
+}
+
+// stripDataURI turns a "data:image/png;base64,..." URI into its base64
+// payload. Values without the data: scheme pass through unchanged.
+func stripDataURI(img string) (string, error) {
+	if !strings.HasPrefix(img, "data:") {
+		return img, nil
+	}
+	header, data, ok := strings.Cut(img, ",")
+	if !ok {
+		return "", fmt.Errorf("malformed data URI")
+	}
+	mime, encoding, _ := strings.Cut(strings.TrimPrefix(header, "data:"), ";")
+	if !strings.HasPrefix(mime, "image/") {
+		return "", fmt.Errorf("unsupported data URI type %q", mime)
+	}
+	if encoding != "base64" {
+		return "", fmt.Errorf("data URI must be base64 encoded")
+	}
+	return data, nil
+}
+
+func streamOllama(w http.ResponseWriter, r *http.Request, url string, payload interface{}, req ClientRequest, useResponse bool) {
+	if !acquireSSE(w) {
+		return
+	}
+	defer releaseSSE()
+
+	var shared *sharedSession
+	if req.SessionID != "" {
+		var ok bool
+		if shared, ok = startSharedSession(req.SessionID); !ok {
+			http.Error(w, "Session already streaming", http.StatusConflict)
+			return
+		}
+		defer finishSharedSession(req.SessionID, shared)
+	}
+
+	data, _ := json.Marshal(payload)
+
+	ctx, span := startSpan(r.Context(), "ollama "+req.ActionType, spanKindClient)
+	defer span.end()
+	span.setAttr("webolla.action", req.ActionType)
+	span.setAttr("webolla.model", req.Model)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	httpReq, _ := newUpstreamRequest(ctx, http.MethodPost, url, bytes.NewReader(data))
+
+	// The ID is echoed back so the client can cancel the request by it.
+	id := cmp.Or(req.RequestID, requestID(r))
+	w.Header().Set("X-Request-ID", id)
+	defer trackRequest(id, cancel)()
+
+	rec := AuditRecord{RequestID: id, Client: r.RemoteAddr, Action: req.ActionType, Model: req.Model}
+	var reply strings.Builder
+	defer func() { auditGeneration(rec, req, reply.String()) }()
+
+	// responded is set by the first chunk that isn't an error; until then
+	// the model may not even exist.
+	var failed, responded bool
+	var evalCount int
+	var evalDuration int64
+	defer func() {
+		// A request given up before any reply says nothing about the model.
+		if responded || failed {
+			modelMetrics.record(req.Model, evalCount, evalDuration, failed)
+		}
+		if responded && !failed {
+			modelUsage.touch(req.Model)
+		}
+	}()
+
+	// The stream is only committed once there is something to send, so an
+	// upstream that fails straight away still gets a plain HTTP error.
+	var sse *sseWriter
+
+	// finished is set once [DONE] has been written; nothing may be written
+	// after it, even if a malformed upstream keeps sending chunks.
+	finished := false
+	send := func(data []byte) {
+		if finished {
+			return
+		}
+		if sse == nil {
+			sse = newSSEWriter(w)
+		}
+		sse.send(data)
+		if shared != nil {
+			shared.publish(data)
+		}
+	}
+	emit := func(v interface{}) {
+		out, _ := json.Marshal(v)
+		send(out)
+	}
+	// A request cancelled through the registry, rather than by the client
+	// going away, still has someone listening; end its stream cleanly.
+	endIfCancelled := func() {
+		if ctx.Err() != nil && r.Context().Err() == nil {
+			rec.DoneReason = "cancelled"
+			emit(map[string]string{"type": "stopped", "reason": "cancelled"})
+			send([]byte("[DONE]"))
+			finished = true
+		}
+	}
+
+	// Behind MAX_CONCURRENT_GENERATIONS, tell the client its place in line
+	// each time the queue moves.
+	ticket := generations.enter()
+	defer generations.leave(ticket)
+	for pos := generations.position(ticket); pos > 0; pos = generations.position(ticket) {
+		emit(map[string]interface{}{"type": "queued", "position": pos})
+		select {
+		case <-ticket.ready:
+		case <-ticket.moved:
+		case <-ctx.Done():
+			endIfCancelled()
+			return
+		}
+	}
+	firstOutput := startPendingLoad(req.Model)
+	defer firstOutput()
+	upstream := readUpstream(ctx, httpReq)
+
+	trimming := trimResponse
+	if req.TrimLeadingWhitespace != nil {
+		trimming = *req.TrimLeadingWhitespace
+	}
+	// A seeded reply is a continuation; its whitespace is significant.
+	trimming = trimming && (useResponse || req.AssistantPrefix == "")
+	held := ""
+
+	// The model only continues the prefix, so replay it to the client first
+	// to give it the complete text.
+	if !useResponse && req.AssistantPrefix != "" {
+		reply.WriteString(req.AssistantPrefix)
+		emit(OllamaResponseChunk{Model: req.Model, Message: &Message{Role: "assistant", Content: req.AssistantPrefix}})
+	}
+
+	guard := repetitionRepeats > 0
+	if req.StopOnRepetition != nil {
+		guard = *req.StopOnRepetition
+	}
+	var loop *repetitionDetector
+	if guard {
+		loop = newRepetitionDetector(cmp.Or(repetitionRepeats, defaultRepetitionRepeats), repetitionMinCycle, repetitionMaxCycle)
+	}
+
+	split, inThought := req.splitThinking(), false
+	warnedUTF8 := false
+	var tools toolCallBuilder
+
+	var filter *contentFilter
+	if len(contentFilters) > 0 {
+		filter = newContentFilter(contentFilters, contentFilterTail)
+	}
+
+	// Until the first content arrives Ollama is typically loading the
+	// model; tell the client how long it has been waiting.
+	start := time.Now()
+	loading := time.NewTicker(loadingInterval)
+	defer loading.Stop()
+
+	// Telemetry is written from this loop too, so the ResponseWriter
+	// only ever has one writer.
+	var telemetryTick <-chan time.Time
+	if req.IncludeTelemetry {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		telemetryTick = t.C
+	}
+
+	for {
+		var ev upstreamEvent
+		var ok bool
+		select {
+		case ev, ok = <-upstream:
+		case <-loading.C:
+			emit(map[string]interface{}{"type": "loading", "elapsed_ms": time.Since(start).Milliseconds()})
+			continue
+		case <-telemetryTick:
+			emit(TelemetryEvent{Type: "telemetry", GpuStats: getArcStats()})
+			continue
+		}
+		if !ok {
+			endIfCancelled()
+			break
+		}
+		if ev.err != nil {
+			if ctx.Err() != nil && r.Context().Err() == nil {
+				endIfCancelled()
+				break
+			}
+			failed = true
+			rec.Error = ev.err.Error()
+			if sse == nil {
+				writeUpstreamError(w, ev.err)
+				return
+			}
+			log.Printf("Upstream stream ended: %v", ev.err)
+			message := unreachableMessage
+			if errors.Is(ev.err, errUpstreamIdle) {
+				message = "Ollama stopped sending data mid-stream"
+			}
+			emit(map[string]string{"type": "error", "error": message})
+			break
+		}
+		chunk := ev.chunk
+		if ev.invalidUTF8 && !warnedUTF8 {
+			log.Printf("%s sent invalid UTF-8; %s", req.Model, invalidUTF8Action())
+			emit(map[string]string{"type": "warning", "warning": "invalid_utf8", "message": "The model produced invalid UTF-8; " + invalidUTF8Action()})
+			warnedUTF8 = true
+		}
+		thinking := chunk.takeThinking()
+		toolCalls := chunk.takeToolCalls()
+		if chunk.content() != "" || thinking != "" || len(toolCalls) > 0 || chunk.Done {
+			loading.Stop()
+			firstOutput()
+		}
+		// Tool calls are forwarded piece by piece as they arrive and once
+		// more, complete, just before the done chunk.
+		for _, tc := range toolCalls {
+			emit(tools.add(tc))
+		}
+		if chunk.Done && len(tools.calls) > 0 {
+			emit(map[string]interface{}{"type": "tool_calls", "tool_calls": tools.result()})
+		}
+		if len(toolCalls) > 0 && thinking == "" && chunk.content() == "" && !chunk.Done && chunk.Error == "" {
+			continue
+		}
+		// Without the split, thinking goes back into the content, tagged
+		// the way reasoning models write it inline.
+		if !split && (thinking != "" || inThought) {
+			var b strings.Builder
+			if thinking != "" && !inThought {
+				b.WriteString("<think>")
+				inThought = true
+			}
+			b.WriteString(thinking)
+			if inThought && (chunk.content() != "" || chunk.Done) {
+				b.WriteString("</think>\n\n")
+				inThought = false
+			}
+			b.WriteString(chunk.content())
+			chunk.setContent(b.String())
+			thinking = ""
+		}
+		// Thinking goes out as its own events so clients never mix it into
+		// the reply; a chunk that only carried thinking is not forwarded.
+		if thinking != "" {
+			emit(map[string]string{"type": "thinking", "content": thinking})
+			if chunk.content() == "" && !chunk.Done && chunk.Error == "" {
+				continue
+			}
+		}
+		if chunk.Error != "" {
+			failed = true
+			rec.Error = chunk.Error
+			chunk.Error, chunk.Detail = explainUpstreamError(chunk.Error)
+		} else {
+			responded = true
+		}
+
+		// Some older Ollama versions and proxies put chat content in
+		// "response"; normalise it so chat clients only read message.
+		if !useResponse && chunk.Message == nil && chunk.Response != "" {
+			chunk.Message = &Message{Role: "assistant", Content: chunk.Response}
+			chunk.Response = ""
+		}
+
+		// Hold back whitespace-only chunks until real content arrives, then
+		// drop the leading blank lines but keep the first line's indentation
+		// so code blocks survive.
+		if trimming {
+			text := held + chunk.content()
+			if strings.TrimSpace(text) == "" && !chunk.Done && chunk.Error == "" {
+				held = text
+				continue
+			}
+			lead := len(text) - len(strings.TrimLeft(text, " \t\r\n"))
+			if i := strings.LastIndex(text[:lead], "\n"); i >= 0 {
+				text = text[i+1:]
+			}
+			chunk.setContent(text)
+			trimming, held = false, ""
+		}
+
+		if filter != nil {
+			text := filter.push(chunk.content())
+			if chunk.Done || chunk.Error != "" {
+				text += filter.flush()
+			} else if text == "" {
+				continue
+			}
+			// The done chunk of a chat may carry no message to put the
+			// released tail in.
+			if !useResponse && chunk.Message == nil && text != "" {
+				chunk.Message = &Message{Role: "assistant"}
+			}
+			chunk.setContent(text)
+		}
+
+		reply.WriteString(chunk.content())
+
+		emit(chunk)
+		if loop != nil && loop.add(chunk.content()) {
+			log.Printf("Stopping %s: output is repeating itself", req.Model)
+			rec.DoneReason = "repetition"
+			emit(map[string]string{"type": "stopped", "reason": "repetition"})
+			send([]byte("[DONE]"))
+			finished = true
+			cancel()
+			break
+		}
+		if chunk.Done {
+			if !useResponse {
+				browserSessionFromContext(r.Context()).recordChat(req.Messages, reply.String())
+				if req.conv != nil {
+					req.conv.record(req.Messages, reply.String())
+				}
+			}
+			span.setAttr("webolla.eval_count", chunk.EvalCount)
+			addTokens(r, chunk.EvalCount)
+			evalCount, evalDuration = chunk.EvalCount, chunk.EvalDuration
+			rec.DoneReason, rec.EvalCount = chunk.DoneReason, chunk.EvalCount
+
+			emit(StreamStats{
+				Type:            "stats",
+				Model:           chunk.Model,
+				DoneReason:      chunk.DoneReason,
+				TotalDuration:   chunk.TotalDuration,
+				LoadDuration:    chunk.LoadDuration,
+				PromptEvalCount: chunk.PromptEvalCount,
+				EvalCount:       chunk.EvalCount,
+				EvalDuration:    chunk.EvalDuration,
+				ResponseSHA256:  responseSHA256(reply.String()),
+			})
+			send([]byte("[DONE]"))
+			finished = true
+
+			// Release the upstream connection now rather than on return
+			// so any trailing bytes can't be read into this stream.
+			cancel()
+			break
+		}
+	}
+}
+
+// activeRequests maps the ID of each generation, streamed or not, to the
+// cancel func of its upstream call.
+var activeRequests = struct {
+	sync.Mutex
+	m map[string]*activeRequest
+}{m: make(map[string]*activeRequest)}
+
+type activeRequest struct {
+	cancel context.CancelFunc
+}
+
+// trackRequest registers a request for cancellation and returns the func
+// that unregisters it. A reused ID belongs to the newest request; an older
+// one finishing doesn't unregister it.
+func trackRequest(id string, cancel context.CancelFunc) func() {
+	entry := &activeRequest{cancel: cancel}
+	activeRequests.Lock()
+	activeRequests.m[id] = entry
+	activeRequests.Unlock()
+	return func() {
+		activeRequests.Lock()
+		if activeRequests.m[id] == entry {
+			delete(activeRequests.m, id)
+		}
+		activeRequests.Unlock()
+	}
+}
+
+// cancelRequest stops the active request with the given ID, reporting
+// whether there was one.
+func cancelRequest(id string) bool {
+	activeRequests.Lock()
+	entry, ok := activeRequests.m[id]
+	activeRequests.Unlock()
+	if ok {
+		entry.cancel()
+	}
+	return ok
+}
+
+// handleCancelRequest is the form of DELETE /api/requests/{id} for simple
+// clients: POST {"requestId": "..."} from the UI's Cancel button, or the ID
+// in ?id= on a GET or a navigator.sendBeacon POST as a page unloads.
+func handleCancelRequest(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" && r.Method == http.MethodPost {
+		var body struct {
+			RequestID string `json:"requestId"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		id = body.RequestID
+	}
+	if id == "" {
+		http.Error(w, "A requestId is required", http.StatusBadRequest)
+		return
+	}
+	if !cancelRequest(id) {
+		http.Error(w, fmt.Sprintf("No active request %q", id), http.StatusNotFound)
+		return
+	}
+	log.Printf("Request %s cancelled by %s", id, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleDeleteRequest(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !cancelRequest(id) {
+		http.Error(w, fmt.Sprintf("No active request %q", id), http.StatusNotFound)
+		return
+	}
+	log.Printf("Request %s cancelled by %s", id, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// activePulls maps each model being pulled to the cancel func of its pull,
+// so a pull can be stopped by name.
+var activePulls = struct {
+	sync.Mutex
+	m map[string]*activeRequest
+}{m: make(map[string]*activeRequest)}
+
+// trackPull registers a pull for cancellation and returns the func that
+// unregisters it, like trackRequest.
+func trackPull(model string, cancel context.CancelFunc) func() {
+	model = fullModelName(model)
+	entry := &activeRequest{cancel: cancel}
+	activePulls.Lock()
+	activePulls.m[model] = entry
+	activePulls.Unlock()
+	return func() {
+		activePulls.Lock()
+		if activePulls.m[model] == entry {
+			delete(activePulls.m, model)
+		}
+		activePulls.Unlock()
+	}
+}
+
+// cancelPull stops the active pull of model, reporting whether there was one.
+func cancelPull(model string) bool {
+	activePulls.Lock()
+	entry, ok := activePulls.m[fullModelName(model)]
+	activePulls.Unlock()
+	if ok {
+		entry.cancel()
+	}
+	return ok
+}
+
+func handlePullCancel(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Model string `json:"model"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Model == "" {
+		http.Error(w, "A model name is required", http.StatusBadRequest)
+		return
+	}
+	if !cancelPull(body.Model) {
+		http.Error(w, fmt.Sprintf("No active pull of %s", body.Model), http.StatusNotFound)
+		return
+	}
+	log.Printf("Pull of %s cancelled by %s", body.Model, r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pendingLoads holds the streaming requests still waiting for their first
+// output, by model. While Ollama loads a model every request for it waits
+// there, which is how a cold load shows from outside.
+var pendingLoads = struct {
+	sync.Mutex
+	m map[string]map[*time.Time]bool
+}{m: make(map[string]map[*time.Time]bool)}
+
+// loadStormGrace is how long a request may wait for its first output before
+// its model counts as loading rather than just evaluating the prompt.
+const loadStormGrace = time.Second
+
+// startPendingLoad records a request waiting on model and returns the func
+// to call once it has output (safe to call more than once).
+func startPendingLoad(model string) func() {
+	model = fullModelName(model)
+	since := time.Now()
+	pendingLoads.Lock()
+	if pendingLoads.m[model] == nil {
+		pendingLoads.m[model] = make(map[*time.Time]bool)
+	}
+	pendingLoads.m[model][&since] = true
+	pendingLoads.Unlock()
+
+	return sync.OnceFunc(func() {
+		pendingLoads.Lock()
+		delete(pendingLoads.m[model], &since)
+		if len(pendingLoads.m[model]) == 0 {
+			delete(pendingLoads.m, model)
+		}
+		pendingLoads.Unlock()
+	})
+}
+
+// modelLoading reports whether model is in the middle of a cold load: a
+// request for it has waited past loadStormGrace with no output, and Ollama
+// doesn't list it as loaded yet. If /api/ps can't be read it says no:
+// a spurious 503 is worse than letting the request queue.
+func modelLoading(ctx context.Context, model string) bool {
+	model = fullModelName(model)
+	pendingLoads.Lock()
+	waiting := false
+	for since := range pendingLoads.m[model] {
+		waiting = waiting || time.Since(*since) > loadStormGrace
+	}
+	pendingLoads.Unlock()
+	if !waiting {
+		return false
+	}
+
+	running, err := fetchRunning(ctx)
+	if err != nil {
+		return false
+	}
+	return !slices.ContainsFunc(running, func(m RunningModel) bool { return fullModelName(m.Name) == model })
+}
+
+// sseConnections counts open SSE streams against MAX_SSE_CONNECTIONS.
+var sseConnections atomic.Int64
+
+// acquireSSE reserves a stream slot, answering 503 if all are taken. Every
+// successful call must be paired with releaseSSE when the stream ends.
+func acquireSSE(w http.ResponseWriter) bool {
+	if n := sseConnections.Add(1); maxSSEConnections > 0 && n > int64(maxSSEConnections) {
+		sseConnections.Add(-1)
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Too many open streams", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+func releaseSSE() {
+	sseConnections.Add(-1)
+}
+
+// sseWriter writes Server-Sent Events to a ResponseWriter. The
+// ResponseWriter isn't safe for concurrent use, so every event goes through
+// one lock; any goroutine holding the sseWriter may send.
+type sseWriter struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// newSSEWriter sets the event-stream headers; the status is committed with
+// the first event.
+func newSSEWriter(w http.ResponseWriter) *sseWriter {
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher, _ := w.(http.Flusher)
+	return &sseWriter{w: w, flusher: flusher}
+}
+
+func (s *sseWriter) send(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sseNamedEvents {
+		fmt.Fprintf(s.w, "event: %s\n", sseEventName(data))
+	}
+	fmt.Fprintf(s.w, "data: %s\n\n", data)
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+// sseEventName names an event for SSE_NAMED_EVENTS: its "type" field,
+// "error" for a bare error, "done" for [DONE], and "content" for the
+// model's own chunks, which carry no type.
+func sseEventName(data []byte) string {
+	if string(data) == "[DONE]" {
+		return "done"
+	}
+	var ev struct {
+		Type  string `json:"type"`
+		Error string `json:"error"`
+	}
+	_ = json.Unmarshal(data, &ev)
+	switch {
+	case ev.Type != "":
+		return ev.Type
+	case ev.Error != "":
+		return "error"
+	}
+	return "content"
+}
+
+// flush commits the response even if nothing has been sent yet, so the
+// client sees the stream open.
+func (s *sseWriter) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+func (s *sseWriter) emit(v interface{}) {
+	data, _ := json.Marshal(v)
+	s.send(data)
+}
+
+func (s *sseWriter) done() {
+	s.send([]byte("[DONE]"))
+}
+
+type upstreamEvent struct {
+	chunk OllamaResponseChunk
+	err   error
+	// invalidUTF8 is set when the chunk had bytes that weren't valid UTF-8;
+	// they have been replaced or dropped per INVALID_UTF8.
+	invalidUTF8 bool
+}
+
+// sanitizeUTF8 fixes invalid UTF-8 in a raw chunk before it is decoded, so
+// the bytes are dropped or replaced as configured rather than however the
+// JSON decoder sees fit. It reports whether anything was changed.
+func sanitizeUTF8(raw json.RawMessage) (json.RawMessage, bool) {
+	if utf8.Valid(raw) {
+		return raw, false
+	}
+	replacement := "\uFFFD"
+	if invalidUTF8Mode == "drop" {
+		replacement = ""
+	}
+	return json.RawMessage(strings.ToValidUTF8(string(raw), replacement)), true
+}
+
+// invalidUTF8Action describes what INVALID_UTF8 does with bad bytes.
+func invalidUTF8Action() string {
+	if invalidUTF8Mode == "drop" {
+		return "the bad bytes were dropped"
+	}
+	return "the bad bytes were replaced with U+FFFD"
+}
+
+// contentFilterRule is one regex→replacement rule from the CONTENT_FILTERS
+// file. Replacement may use $1-style group references.
+type contentFilterRule struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+	re          *regexp.Regexp
+}
+
+// loadContentFilters reads a JSON array of rules, e.g.
+// [{"pattern": "\\b\\d{16}\\b", "replacement": "[card]"}].
+func loadContentFilters(path string) ([]contentFilterRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []contentFilterRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		if rules[i].re, err = regexp.Compile(rules[i].Pattern); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return rules, nil
+}
+
+// contentFilter applies the rules to streamed text. A match can straddle
+// two chunks, so the last tail bytes are held back until more text arrives
+// (or the stream ends); matches longer than tail can still slip through
+// when split.
+type contentFilter struct {
+	rules   []contentFilterRule
+	tail    int
+	pending string
+}
+
+func newContentFilter(rules []contentFilterRule, tail int) *contentFilter {
+	return &contentFilter{rules: rules, tail: tail}
+}
+
+// push adds newly streamed text and returns the part that is now safe to
+// emit, already filtered.
+func (f *contentFilter) push(text string) string {
+	buf := f.pending + text
+	cut := max(len(buf)-f.tail, 0)
+	// Never split a match that runs into the held-back tail; keep it whole
+	// so it is replaced once all of it has arrived.
+	for moved := true; moved && cut > 0; {
+		moved = false
+		for _, rule := range f.rules {
+			for _, m := range rule.re.FindAllStringIndex(buf, -1) {
+				if m[0] < cut && m[1] > cut {
+					cut, moved = m[0], true
+				}
+			}
+		}
+	}
+	for cut > 0 && cut < len(buf) && !utf8.RuneStart(buf[cut]) {
+		cut--
+	}
+	f.pending = buf[cut:]
+	return f.apply(buf[:cut])
+}
+
+// flush returns whatever is still held back, filtered.
+func (f *contentFilter) flush() string {
+	out := f.apply(f.pending)
+	f.pending = ""
+	return out
+}
+
+func (f *contentFilter) apply(text string) string {
+	for _, rule := range f.rules {
+		text = rule.re.ReplaceAllString(text, rule.Replacement)
+	}
+	return text
+}
+
+// defaultRepetitionRepeats is used when a request asks for the loop detector
+// but REPETITION_STOP_REPEATS is unset.
+const defaultRepetitionRepeats = 4
+
+// repetitionDetector spots a model stuck in a loop: the tail of its output
+// being the same span of text, between minCycle and maxCycle characters
+// long, repeated back to back repeats times. The minimum keeps legitimate
+// short runs (a row of dashes, "ha ha ha") from tripping it.
+type repetitionDetector struct {
+	repeats, minCycle, maxCycle int
+	tail                        []byte
+}
+
+func newRepetitionDetector(repeats, minCycle, maxCycle int) *repetitionDetector {
+	return &repetitionDetector{repeats: max(repeats, 2), minCycle: minCycle, maxCycle: maxCycle}
+}
+
+// add appends newly streamed text and reports whether the output is now
+// looping.
+func (d *repetitionDetector) add(text string) bool {
+	if text == "" {
+		return false
+	}
+	d.tail = append(d.tail, text...)
+	if keep := d.maxCycle * d.repeats; len(d.tail) > keep {
+		d.tail = append(d.tail[:0], d.tail[len(d.tail)-keep:]...)
+	}
+
+	n := len(d.tail)
+	for cycle := d.minCycle; cycle <= d.maxCycle && cycle*d.repeats <= n; cycle++ {
+		// The last cycle*repeats bytes repeat with period cycle iff each
+		// byte equals the one cycle positions before it.
+		start, looping := n-cycle*d.repeats, true
+		for i := n - 1; i >= start+cycle; i-- {
+			if d.tail[i] != d.tail[i-cycle] {
+				looping = false
+				break
+			}
+		}
+		if looping {
+			return true
+		}
+	}
+	return false
+}
+
+// firstByteRetryBackoff is the wait before the first retry of a stream that
+// failed before its first byte; it doubles with each further attempt.
+const firstByteRetryBackoff = 500 * time.Millisecond
+
+// maxPendingChunk bounds how much unparsed text an ndjsonReader holds while
+// waiting for the rest of an object.
+const maxPendingChunk = 1 << 20
+
+// ndjsonReader reads Ollama's newline-delimited chunks. A line that isn't
+// valid JSON by itself is held and joined with the lines after it until
+// they make one, for proxies that break a chunk up; if a following line is
+// valid on its own instead, the held text was garbage and is dropped, so
+// one bad line costs that line and not the rest of the stream.
+type ndjsonReader struct {
+	r       *bufio.Reader
+	pending []byte
+}
+
+func (c *ndjsonReader) next() (json.RawMessage, error) {
+	for {
+		line, err := c.r.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			if len(c.pending) == 0 && json.Valid(line) {
+				return line, nil
+			}
+			if len(c.pending) > 0 {
+				joined := append(append(c.pending, '\n'), line...)
+				switch {
+				case json.Valid(joined):
+					c.pending = nil
+					return joined, nil
+				case json.Valid(line):
+					log.Printf("Skipping malformed chunk: %.200q", c.pending)
+					c.pending = nil
+					return line, nil
+				}
+				c.pending = joined
+			} else {
+				c.pending = line
+			}
+			if len(c.pending) > maxPendingChunk {
+				log.Printf("Skipping malformed chunk: over %d bytes without a complete object", maxPendingChunk)
+				c.pending = nil
+			}
+		}
+		if err != nil {
+			if len(c.pending) > 0 {
+				log.Printf("Skipping malformed chunk at end of stream: %.200q", c.pending)
+				c.pending = nil
+			}
+			return nil, err
+		}
+	}
+}
+
+// readUpstream performs the streaming request and decodes the response on
+// its own goroutine, so the caller can interleave other events (loading
+// progress, etc.) while it waits. Chunks are read with an ndjsonReader, so
+// one that arrives split up is reassembled and a malformed one is skipped.
+// A request that fails before anything is delivered is retried up to
+// STREAM_FIRST_BYTE_RETRIES times; once a chunk is out it never is.
+// The channel is closed at the end of the stream; cancel ctx to stop early.
+func readUpstream(ctx context.Context, req *http.Request) <-chan upstreamEvent {
+	events := make(chan upstreamEvent)
+	deliver := func(ev upstreamEvent) bool {
+		select {
+		case events <- ev:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	// attempt makes one request. It reports retry, with the reason, when it
+	// failed before anything was delivered and canRetry allows another go.
+	attempt := func(req *http.Request, canRetry bool) (bool, error) {
+		canRetry = canRetry && req.GetBody != nil
+		resp, err := generateClient.Do(req)
+		if err != nil {
+			if canRetry && ctx.Err() == nil {
+				return true, err
+			}
+			deliver(upstreamEvent{err: err})
+			return false, nil
+		}
+		defer resp.Body.Close()
+		if canRetry && retryableStatus(resp.StatusCode) {
+			return true, fmt.Errorf("upstream returned %s", resp.Status)
+		}
+
+		var body io.Reader = resp.Body
+		if upstreamIdleTimeout > 0 {
+			idle := newIdleTimeoutReader(resp.Body, upstreamIdleTimeout)
+			defer idle.stop()
+			body = idle
+		}
+		chunks := &ndjsonReader{r: bufio.NewReader(body)}
+		for first := true; ; first = false {
+			raw, err := chunks.next()
+			if err != nil {
+				if first && canRetry && ctx.Err() == nil {
+					return true, err
+				}
+				if err != io.EOF {
+					deliver(upstreamEvent{err: err})
+				}
+				return false, nil
+			}
+			raw, invalid := sanitizeUTF8(raw)
+			var chunk OllamaResponseChunk
+			if err := json.Unmarshal(raw, &chunk); err != nil {
+				log.Printf("Skipping malformed chunk: %v", err)
+				continue
+			}
+			if first && canRetry && transientUpstreamError(chunk.Error) {
+				return true, errors.New(chunk.Error)
+			}
+			if !deliver(upstreamEvent{chunk: chunk, invalidUTF8: invalid}) {
+				return false, nil
+			}
+		}
+	}
+
+	go func() {
+		defer close(events)
+		for n := 0; ; n++ {
+			retry, err := attempt(req, n < streamFirstByteRetries)
+			if !retry {
+				return
+			}
+			backoff := firstByteRetryBackoff << n
+			log.Printf("Upstream failed before the first byte (attempt %d), retrying in %s: %v", n+1, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			req = req.Clone(ctx)
+			req.Body, _ = req.GetBody()
+		}
+	}()
+	return events
+}
+
+var errUpstreamIdle = errors.New("upstream idle timeout")
+
+// idleTimeoutReader guards a streaming body against an upstream that stalls
+// or dribbles: a read that waits longer than timeout closes the body and
+// fails with errUpstreamIdle. The clock only runs inside Read, so a slow
+// consumer doesn't count against the upstream, and only once the first
+// bytes are in; waiting for those is the model loading, not a stall.
+type idleTimeoutReader struct {
+	body     io.ReadCloser
+	timeout  time.Duration
+	timer    *time.Timer
+	started  bool
+	timedOut atomic.Bool
+}
+
+func newIdleTimeoutReader(body io.ReadCloser, timeout time.Duration) *idleTimeoutReader {
+	r := &idleTimeoutReader{body: body, timeout: timeout}
+	r.timer = time.AfterFunc(timeout, func() {
+		r.timedOut.Store(true)
+		body.Close()
+	})
+	r.timer.Stop()
+	return r
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	if r.started {
+		r.timer.Reset(r.timeout)
+	}
+	n, err := r.body.Read(p)
+	r.timer.Stop()
+	r.started = r.started || n > 0
+	if r.timedOut.Load() {
+		return n, fmt.Errorf("%w: no data for %s", errUpstreamIdle, r.timeout)
+	}
+	return n, err
+}
+
+func (r *idleTimeoutReader) stop() {
+	r.timer.Stop()
+}
+
+// retryableStatus reports whether an upstream status is worth retrying
+// before the stream has started.
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// transientErrorHints are the parts of Ollama error messages that mean it
+// was busy or mid-load rather than that the request can never work. They
+// are kept to whole phrases: "error loading model" or an unexpected EOF
+// reading a blob comes from a corrupt or unsupported model and never
+// succeeds on a retry.
+var transientErrorHints = []string{"model is loading", "server busy", "server overloaded", "too many requests", "try again"}
+
+// transientUpstreamError reports whether an error from the first chunk is
+// worth retrying. "model not found" and the like are not: retrying only
+// makes the caller wait longer for the same answer.
+func transientUpstreamError(msg string) bool {
+	lower := strings.ToLower(msg)
+	return slices.ContainsFunc(transientErrorHints, func(h string) bool { return strings.Contains(lower, h) })
+}
+
+// AuditRecord is one line of the AUDIT_LOG_PATH JSON-lines log, written
+// when a generation ends, however it ends. ResponseSHA256 covers the text
+// sent before then; Error is set when Ollama failed.
+type AuditRecord struct {
+	Time           time.Time `json:"time"`
+	RequestID      string    `json:"request_id"`
+	Client         string    `json:"client"`
+	Action         string    `json:"action"`
+	Model          string    `json:"model"`
+	Prompt         string    `json:"prompt,omitempty"`
+	Messages       []Message `json:"messages,omitempty"`
+	DoneReason     string    `json:"done_reason,omitempty"`
+	EvalCount      int       `json:"eval_count"`
+	ResponseSHA256 string    `json:"response_sha256"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// auditGeneration writes rec for a generation that just ended, sampling
+// whether the prompt goes with it.
+func auditGeneration(rec AuditRecord, req ClientRequest, reply string) {
+	rec.Time = time.Now()
+	rec.ResponseSHA256 = responseSHA256(reply)
+	if samplePrompt(rec.RequestID, promptSampleRate) {
+		rec.Prompt, rec.Messages = req.Prompt, req.Messages
+	}
+	writeAudit(rec)
+}
+
+// responseSHA256 is the hex SHA-256 of a reply's text, as reported in the
+// stats event and the audit log.
+func responseSHA256(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+var auditMu sync.Mutex
+
+// requestID returns the client's X-Request-ID, or a random one if it sent none.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" {
+		return id
+	}
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// samplePrompt decides whether the full prompt of a request is audited.
+// The decision is a hash of the request ID rather than a coin flip, so
+// replaying a request ID always gives the same answer.
+func samplePrompt(id string, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	sum := sha256.Sum256([]byte(id))
+	return float64(binary.BigEndian.Uint64(sum[:8]))/math.MaxUint64 < rate
+}
+
+func writeAudit(rec AuditRecord) {
+	if auditLogPath == "" {
+		return
+	}
+	if auditRedactImages {
+		rec.Messages = redactImages(rec.Messages)
+	}
+	var line bytes.Buffer
+	enc := json.NewEncoder(&line)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(rec)
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	f, err := os.OpenFile(auditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("Audit log: %v", err)
+		return
+	}
+	defer f.Close()
+	f.Write(line.Bytes())
+}
+
+// redactImages returns a copy of messages with each image replaced by its
+// size and a short hash, so audit lines stay readable but the same image can
+// still be matched across records.
+func redactImages(messages []Message) []Message {
+	out := slices.Clone(messages)
+	for i, m := range out {
+		if len(m.Images) == 0 {
+			continue
+		}
+		images := make([]string, len(m.Images))
+		for j, img := range m.Images {
+			data := []byte(img)
+			if raw, err := stripDataURI(img); err == nil {
+				if decoded, err := base64.StdEncoding.DecodeString(raw); err == nil {
+					data = decoded
+				}
+			}
+			sum := sha256.Sum256(data)
+			images[j] = fmt.Sprintf("<image:%d bytes sha256:%s>", len(data), hex.EncodeToString(sum[:8]))
+		}
+		out[i].Images = images
+	}
+	return out
+}
+
+const (
+	sharedSessionRetention = 5 * time.Minute
+	sharedSessionBuffer    = 256
+	// sharedSessionReplayBytes caps the replay kept for late joiners; past
+	// it the oldest events are dropped.
+	sharedSessionReplayBytes = 1 << 20
+)
+
+// sharedSession buffers the events of one generation so other clients can
+// join it via /api/session/{id}/stream. Late joiners get a replay of the
+// buffered events, up to sharedSessionReplayBytes of the latest ones;
+// subscribers that fall behind drop events instead of stalling the
+// generation.
+type sharedSession struct {
+	mu     sync.Mutex
+	events [][]byte
+	size   int
+	subs   map[chan []byte]struct{}
+	done   bool
+}
+
+var sharedSessions = struct {
+	sync.Mutex
+	m map[string]*sharedSession
+}{m: make(map[string]*sharedSession)}
+
+// startSharedSession registers a new live session. It fails if a generation
+// with the same ID is still streaming.
+func startSharedSession(id string) (*sharedSession, bool) {
+	sharedSessions.Lock()
+	defer sharedSessions.Unlock()
+
+	if s, ok := sharedSessions.m[id]; ok {
+		s.mu.Lock()
+		live := !s.done
+		s.mu.Unlock()
+		if live {
+			return nil, false
+		}
+	}
+	s := &sharedSession{subs: make(map[chan []byte]struct{})}
+	sharedSessions.m[id] = s
+	return s, true
+}
+
+// finishSharedSession closes all subscribers and keeps the buffer around for
+// sharedSessionRetention so late joiners can still replay it.
+func finishSharedSession(id string, s *sharedSession) {
+	s.mu.Lock()
+	s.done = true
+	for ch := range s.subs {
+		close(ch)
+	}
+	s.subs = nil
+	s.mu.Unlock()
+
+	time.AfterFunc(sharedSessionRetention, func() {
+		sharedSessions.Lock()
+		if sharedSessions.m[id] == s {
+			delete(sharedSessions.m, id)
+		}
+		sharedSessions.Unlock()
+	})
+}
+
+func (s *sharedSession) publish(event []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append(s.events, event)
+	s.size += len(event)
+	drop := 0
+	for s.size > sharedSessionReplayBytes && drop < len(s.events)-1 {
+		s.size -= len(s.events[drop])
+		drop++
+	}
+	s.events = slices.Delete(s.events, 0, drop)
+	for ch := range s.subs {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// join returns the events so far and, unless the session already finished,
+// a channel carrying the live ones.
+func (s *sharedSession) join() ([][]byte, chan []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	replay := append([][]byte(nil), s.events...)
+	if s.done {
+		return replay, nil
+	}
+	ch := make(chan []byte, sharedSessionBuffer)
+	s.subs[ch] = struct{}{}
+	return replay, ch
+}
+
+func (s *sharedSession) leave(ch chan []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.subs[ch]; ok {
+		delete(s.subs, ch)
+		close(ch)
+	}
+}
+
+func handleSessionStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sharedSessions.Lock()
+	s, ok := sharedSessions.m[r.PathValue("id")]
+	sharedSessions.Unlock()
+	if !ok {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	}
+
+	if !acquireSSE(w) {
+		return
+	}
+	defer releaseSSE()
+	sse := newSSEWriter(w)
+	replay, ch := s.join()
+	for _, event := range replay {
+		sse.send(event)
+	}
+	sse.flush()
+	if ch == nil {
+		return
+	}
+	defer s.leave(ch)
+
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			sse.send(event)
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// generateOnce runs a non-streaming generate and returns Ollama's single
+// response object.
+func generateOnce(ctx context.Context, payload OllamaGenerateRequestPayload) (*OllamaResponseChunk, error) {
+	payload.Stream = false
+	data, _ := json.Marshal(payload)
+	req, _ := newUpstreamRequest(ctx, http.MethodPost, ollamaGenerateAPI, bytes.NewReader(data))
+
+	resp, err := generateClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var chunk OllamaResponseChunk
+	if err := json.NewDecoder(resp.Body).Decode(&chunk); err != nil {
+		return nil, fmt.Errorf("%s: %w", resp.Status, err)
+	}
+	if chunk.Error != "" {
+		return nil, fmt.Errorf("%s", chunk.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("generate returned %s", resp.Status)
+	}
+	return &chunk, nil
+}
+
+type TestAllRequest struct {
+	Prompt string           `json:"prompt"`
+	Params GenerationParams `json:"params"`
+	Models []string         `json:"models"`
+}
+
+type TestAllResult struct {
+	Type         string  `json:"type"`
+	Model        string  `json:"model"`
+	Response     string  `json:"response,omitempty"`
+	DurationMs   int64   `json:"duration_ms"`
+	EvalCount    int     `json:"eval_count,omitempty"`
+	TokensPerSec float64 `json:"tokens_per_sec,omitempty"`
+	Error        string  `json:"error,omitempty"`
+	Detail       string  `json:"detail,omitempty"`
+}
+
+// handleTestAll runs one prompt against every installed model (or the
+// requested subset) one at a time, to stay within VRAM, streaming a result
+// event per model.
+func handleTestAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req TestAllRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tags, err := fetchTags(r.Context())
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	wanted := make(map[string]bool)
+	for _, m := range req.Models {
+		wanted[m] = true
+	}
+
+	if !acquireSSE(w) {
+		return
+	}
+	defer releaseSSE()
+	sse := newSSEWriter(w)
+	for _, m := range tags.Models {
+		if len(wanted) > 0 && !wanted[m.Name] {
+			continue
+		}
+		if r.Context().Err() != nil {
+			return
+		}
+
+		start := time.Now()
+		chunk, err := generateOnce(r.Context(), OllamaGenerateRequestPayload{
+			Model:   m.Name,
+			Prompt:  req.Prompt,
+			Options: buildOptions(r.Context(), m.Name, req.Params),
+		})
+
+		result := TestAllResult{Type: "result", Model: m.Name, DurationMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			result.Error, result.Detail = explainUpstreamError(err.Error())
+		} else {
+			result.Response = chunk.Response
+			result.EvalCount = chunk.EvalCount
+			if chunk.EvalDuration > 0 {
+				result.TokensPerSec = float64(chunk.EvalCount) / time.Duration(chunk.EvalDuration).Seconds()
+			}
+		}
+
+		sse.emit(result)
+	}
+	sse.done()
+}
+
+const (
+	benchmarkPrompt     = "Write a detailed, multi-paragraph explanation of how a CPU cache hierarchy works."
+	benchmarkMaxRuns    = 20
+	benchmarkNumPredict = 128
+)
+
+type BenchmarkRequest struct {
+	Model      string `json:"model"`
+	Runs       int    `json:"runs"`
+	NumPredict int    `json:"num_predict"`
+}
+
+type BenchmarkRun struct {
+	Type         string  `json:"type"`
+	Run          int     `json:"run"`
+	EvalCount    int     `json:"eval_count"`
+	EvalMs       int64   `json:"eval_ms"`
+	LoadMs       int64   `json:"load_ms"`
+	TokensPerSec float64 `json:"tokens_per_sec"`
+}
+
+type BenchmarkSummary struct {
+	Type            string  `json:"type"`
+	Model           string  `json:"model"`
+	Runs            int     `json:"runs"`
+	WarmupMs        int64   `json:"warmup_ms"`
+	MinTokensPerSec float64 `json:"min_tokens_per_sec"`
+	MaxTokensPerSec float64 `json:"max_tokens_per_sec"`
+	AvgTokensPerSec float64 `json:"avg_tokens_per_sec"`
+	AvgLoadMs       int64   `json:"avg_load_ms"`
+}
+
+// handleBenchmark runs a fixed prompt through one model several times and
+// reports tokens/sec from Ollama's own eval timings, streaming an event per
+// run and a summary at the end. The model is loaded first so the cold start
+// doesn't count against the first run.
+func handleBenchmark(w http.ResponseWriter, r *http.Request) {
+	var req BenchmarkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Model == "" {
+		http.Error(w, "model is required", http.StatusBadRequest)
+		return
+	}
+	if req.Runs <= 0 {
+		req.Runs = 3
+	}
+	req.Runs = min(req.Runs, benchmarkMaxRuns)
+	if req.NumPredict <= 0 {
+		req.NumPredict = benchmarkNumPredict
+	}
+
+	if !acquireSSE(w) {
+		return
+	}
+	defer releaseSSE()
+	sse := newSSEWriter(w)
+	emit := sse.emit
+	fail := func(err error) {
+		emit(errorEvent(err))
+		sse.done()
+	}
+
+	start := time.Now()
+	if _, err := generateOnce(r.Context(), OllamaGenerateRequestPayload{Model: req.Model}); err != nil {
+		fail(err)
+		return
+	}
+	summary := BenchmarkSummary{Type: "summary", Model: req.Model, WarmupMs: time.Since(start).Milliseconds()}
+	emit(map[string]interface{}{"type": "warmup", "model": req.Model, "warmup_ms": summary.WarmupMs})
+
+	// Fixed options so runs are comparable across models and machines.
+	options := map[string]interface{}{"num_predict": req.NumPredict, "temperature": 0, "seed": 42}
+	var totalTPS float64
+	var totalLoad time.Duration
+	for i := 1; i <= req.Runs; i++ {
+		chunk, err := generateOnce(r.Context(), OllamaGenerateRequestPayload{
+			Model:   req.Model,
+			Prompt:  benchmarkPrompt,
+			Options: options,
+		})
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		run := BenchmarkRun{
+			Type:      "run",
+			Run:       i,
+			EvalCount: chunk.EvalCount,
+			EvalMs:    time.Duration(chunk.EvalDuration).Milliseconds(),
+			LoadMs:    time.Duration(chunk.LoadDuration).Milliseconds(),
+		}
+		if chunk.EvalDuration > 0 {
+			run.TokensPerSec = float64(chunk.EvalCount) / time.Duration(chunk.EvalDuration).Seconds()
+		}
+		emit(run)
+
+		if i == 1 || run.TokensPerSec < summary.MinTokensPerSec {
+			summary.MinTokensPerSec = run.TokensPerSec
+		}
+		summary.MaxTokensPerSec = max(summary.MaxTokensPerSec, run.TokensPerSec)
+		totalTPS += run.TokensPerSec
+		totalLoad += time.Duration(chunk.LoadDuration)
+	}
+
+	summary.Runs = req.Runs
+	summary.AvgTokensPerSec = totalTPS / float64(req.Runs)
+	summary.AvgLoadMs = (totalLoad / time.Duration(req.Runs)).Milliseconds()
+	emit(summary)
+	sse.done()
+}
+
+// handlePullAndRun pulls a model if it isn't installed yet, then warms it up,
+// streaming progress and finishing with a "ready" event.
+func handlePullAndRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !actionAllowed(w, "pull") {
+		return
+	}
+
+	var req ClientRequest
+	if err := decodeClientRequest(r.Body, &req); err != nil || req.Model == "" {
+		http.Error(w, "A model name is required", http.StatusBadRequest)
+		return
+	}
+
+	tags, err := fetchTags(r.Context())
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	installed := false
+	for _, m := range tags.Models {
+		installed = installed || fullModelName(m.Name) == fullModelName(req.Model)
+	}
+
+	if !acquireSSE(w) {
+		return
+	}
+	defer releaseSSE()
+	sse := newSSEWriter(w)
+	emit := sse.emit
+	fail := func(err error) {
+		emit(errorEvent(err))
+	}
+
+	if !installed {
+		if !acquirePullSlot(w, r) {
+			return
+		}
+		ctx, cancel := context.WithCancel(r.Context())
+		untrack := trackPull(req.Model, cancel)
+		err := pullModel(ctx, req.Model, func(p OllamaPullProgress) {
+			emit(struct {
+				Type string `json:"type"`
+				OllamaPullProgress
+			}{"pull", p})
+		}, func(retry PullRetry) { emit(retry) })
+		untrack()
+		cancel()
+		<-pullSlots
+		if err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	emit(map[string]string{"type": "warmup", "model": req.Model})
+	start := time.Now()
+	if _, err := generateOnce(r.Context(), OllamaGenerateRequestPayload{Model: req.Model}); err != nil {
+		fail(err)
+		return
+	}
+	emit(map[string]interface{}{
+		"type":      "ready",
+		"model":     req.Model,
+		"pulled":    !installed,
+		"warmup_ms": time.Since(start).Milliseconds(),
+	})
+	sse.done()
+}
+
+// pullRetryBackoff is the wait before the first retry of a pull that hit a
+// transient error; it doubles with each further attempt.
+var pullRetryBackoff = 2 * time.Second
+
+// PullRetry is sent while a pull waits to try again after a transient error.
+type PullRetry struct {
+	Type    string `json:"type"`
+	Attempt int    `json:"attempt"`
+	WaitMS  int64  `json:"wait_ms"`
+	Error   string `json:"error"`
+}
+
+// pullModel streams a pull, passing each progress update to onProgress. A
+// transient failure (connection dropped, upstream 5xx) is retried up to
+// PULL_RETRIES times with backoff, calling onRetry before each wait; Ollama
+// keeps the layers it already has, so the retry resumes rather than starting
+// over. A definitive error, such as an unknown model or a refused
+// registry, ends the pull straight away.
+func pullModel(ctx context.Context, model string, onProgress func(OllamaPullProgress), onRetry func(PullRetry)) error {
+	for n := 0; ; n++ {
+		retryable, err := pullOnce(ctx, model, onProgress)
+		if err == nil || !retryable || n >= pullRetries || ctx.Err() != nil {
+			return err
+		}
+		backoff := pullRetryBackoff << n
+		log.Printf("Pull of %s failed (attempt %d), retrying in %s: %v", model, n+1, backoff, err)
+		onRetry(PullRetry{Type: "retrying", Attempt: n + 1, WaitMS: backoff.Milliseconds(), Error: err.Error()})
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// pullOnce makes one pull request, reporting whether its error is worth
+// retrying.
+func pullOnce(ctx context.Context, model string, onProgress func(OllamaPullProgress)) (bool, error) {
+	data, _ := json.Marshal(map[string]interface{}{"name": model, "stream": true})
+	req, _ := newUpstreamRequest(ctx, http.MethodPost, ollamaPullAPI, bytes.NewReader(data))
+
+	resp, err := pullClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return true, fmt.Errorf("pull returned %s", resp.Status)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var p OllamaPullProgress
+		if err := dec.Decode(&p); err == io.EOF {
+			break
+		} else if err != nil {
+			return true, err
+		}
+		if p.Error != "" {
+			return !definitivePullError(p.Error), fmt.Errorf("%s", p.Error)
+		}
+		onProgress(p)
+		if p.Status == "success" {
+			return false, nil
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("pull returned %s", resp.Status)
+	}
+	return true, fmt.Errorf("pull ended without success")
+}
+
+// definitivePullError reports whether an error Ollama put in the pull
+// stream will only happen again: the model doesn't exist or the registry
+// refused us.
+func definitivePullError(message string) bool {
+	message = strings.ToLower(message)
+	for _, s := range []string{"file does not exist", "not found", "manifest unknown", "unauthorized", "denied", "forbidden", "invalid model name"} {
+		if strings.Contains(message, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventHub pushes model-list and connectivity changes to /api/events
+// subscribers. It keeps the latest event of each kind so new subscribers get
+// the current snapshot on connect.
+type eventHub struct {
+	mu       sync.Mutex
+	subs     map[chan []byte]struct{}
+	snapshot map[string][]byte
+	order    []string
+}
+
+var events = &eventHub{subs: make(map[chan []byte]struct{}), snapshot: make(map[string][]byte)}
+
+func (h *eventHub) publish(kind string, v interface{}) {
+	data, _ := json.Marshal(v)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.snapshot[kind]; !ok {
+		h.order = append(h.order, kind)
+	}
+	h.snapshot[kind] = data
+	for ch := range h.subs {
+		select {
+		case ch <- data:
+		default:
+		}
+	}
+}
+
+func (h *eventHub) subscribe() ([][]byte, chan []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var snapshot [][]byte
+	for _, kind := range h.order {
+		snapshot = append(snapshot, h.snapshot[kind])
+	}
+	ch := make(chan []byte, 16)
+	h.subs[ch] = struct{}{}
+	return snapshot, ch
+}
+
+func (h *eventHub) unsubscribe(ch chan []byte) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+// watchUpstream polls /api/tags and publishes the model list whenever it
+// changes. Connectivity is reported separately by runHealthCheck.
+func watchUpstream(interval time.Duration) {
+	var watch modelListWatch
+	for {
+		watch.poll(context.Background())
+		time.Sleep(interval)
+	}
+}
+
+// installedModels is the model list watchUpstream last fetched, by full
+// name.
+var installedModels = struct {
+	sync.RWMutex
+	names map[string]bool
+}{}
+
+func modelInstalled(model string) bool {
+	installedModels.RLock()
+	defer installedModels.RUnlock()
+	return installedModels.names[fullModelName(model)]
+}
+
+// modelListWatch remembers the last model list published, by hash.
+type modelListWatch struct {
+	lastHash [32]byte
+	seen     bool
+}
+
+// poll fetches the tags once and publishes them if they changed.
+func (m *modelListWatch) poll(ctx context.Context) {
+	tags, err := fetchTags(ctx)
+	if err != nil {
+		return
+	}
+	installed := make(map[string]bool, len(tags.Models))
+	for _, model := range tags.Models {
+		installed[fullModelName(model.Name)] = true
+	}
+	installedModels.Lock()
+	installedModels.names = installed
+	installedModels.Unlock()
+
+	names, _ := json.Marshal(tags.Models)
+	if hash := sha256.Sum256(names); !m.seen || hash != m.lastHash {
+		m.lastHash = hash
+		m.seen = true
+		events.publish("models", map[string]interface{}{"type": "models", "models": tags.Models})
+	}
+}
+
+// runKeepWarm keeps KEEP_WARM_MODELS loaded by sending each an empty
+// generate, which loads the model and resets its keep_alive without
+// generating anything, every interval. A model that vanishes from /api/ps
+// before its keep_alive was up was unloaded on purpose (ollama stop, or to
+// make room), so it is left alone from then on; so is one that has been
+// deleted.
+func runKeepWarm(models []string, interval, keepAlive time.Duration) {
+	lastPing := make(map[string]time.Time)
+	for {
+		var running []RunningModel
+		if len(lastPing) > 0 {
+			var err error
+			if running, err = fetchRunning(context.Background()); err != nil {
+				time.Sleep(interval)
+				continue
+			}
+		}
+		models = slices.DeleteFunc(models, func(model string) bool {
+			at, pinged := lastPing[model]
+			loaded := slices.ContainsFunc(running, func(m RunningModel) bool { return m.Name == model })
+			if pinged && !loaded && time.Since(at) < keepAlive {
+				log.Printf("Keep-warm: %s was unloaded, no longer keeping it warm", model)
+				return true
+			}
+			return false
+		})
+
+		for i := 0; i < len(models); i++ {
+			model := models[i]
+			if err := pingModel(model, keepAlive); err != nil {
+				log.Printf("Keep-warm: %s: %v", model, err)
+				if errors.Is(err, errModelNotFound) {
+					models = slices.Delete(models, i, i+1)
+					i--
+				}
+				continue
+			}
+			lastPing[model] = time.Now()
+		}
+		if len(models) == 0 {
+			log.Printf("Keep-warm: no models left to keep warm")
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+var errModelNotFound = errors.New("model not found")
+
+// pingModel loads model, or refreshes its keep_alive if it is loaded.
+func pingModel(model string, keepAlive time.Duration) error {
+	data, _ := json.Marshal(OllamaGenerateRequestPayload{Model: model, KeepAlive: keepAlive.String()})
+	req, _ := newUpstreamRequest(context.Background(), http.MethodPost, ollamaGenerateAPI, bytes.NewReader(data))
+	resp, err := generateClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return errModelNotFound
+	default:
+		return fmt.Errorf("generate returned %s", resp.Status)
+	}
+}
+
+// healthState is the background-maintained view of whether Ollama is
+// reachable; /api/status serves it without probing.
+type healthState struct {
+	sync.RWMutex
+	connected bool
+	checked   bool
+	failures  int
+}
+
+var health healthState
+
+func (h *healthState) isConnected() bool {
+	h.RLock()
+	defer h.RUnlock()
+	return h.connected
+}
+
+// record folds one probe result into the state and reports whether the
+// connected flag changed. A success reconnects at once, but it takes
+// threshold consecutive failures to disconnect, so one transient blip
+// doesn't show the server as down. The very first probe is taken as is.
+func (h *healthState) record(ok bool, threshold int) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	was, first := h.connected, !h.checked
+	h.checked = true
+	if ok {
+		h.failures = 0
+		h.connected = true
+	} else {
+		h.failures++
+		if first || h.failures >= threshold {
+			h.connected = false
+		}
+	}
+	return first || h.connected != was
+}
+
+func probeUpstream() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := newUpstreamRequest(ctx, http.MethodGet, ollamaTagsAPI, nil)
+	resp, err := listClient.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// runHealthCheck probes Ollama every interval and publishes a status event
+// whenever the connected state flips.
+func runHealthCheck(interval time.Duration, threshold int) {
+	for {
+		if health.record(probeUpstream(), threshold) {
+			connected := health.isConnected()
+			if connected {
+				// Ollama may have been upgraded while it was away.
+				detectOllamaVersion()
+			}
+			events.publish("status", map[string]interface{}{"type": "status", "connected": connected})
+		}
+		time.Sleep(interval)
+	}
+}
+
+// minOllamaVersion is the oldest Ollama release webolla is tested against.
+const minOllamaVersion = "0.3.0"
+
+// ollamaFeatureVersions gives the first Ollama release supporting each
+// optional request feature; older versions get the feature left out of
+// the payload or refused.
+var ollamaFeatureVersions = map[string]string{
+	"tools":    "0.3.0",
+	"think":    "0.9.0",
+	"logprobs": "0.12.11",
+}
+
+var ollamaVersion = struct {
+	sync.RWMutex
+	v string
+}{}
+
+func detectedOllamaVersion() string {
+	ollamaVersion.RLock()
+	defer ollamaVersion.RUnlock()
+	return ollamaVersion.v
+}
+
+// detectOllamaVersion asks Ollama for its version and records it, warning
+// if it is older than minOllamaVersion.
+func detectOllamaVersion() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := newUpstreamRequest(ctx, http.MethodGet, ollamaVersionAPI, nil)
+	resp, err := listClient.Do(req)
+	if err != nil {
+		log.Printf("Ollama version check: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Version == "" {
+		log.Printf("Ollama version check: unexpected response (%s)", resp.Status)
+		return
+	}
+
+	ollamaVersion.Lock()
+	changed := ollamaVersion.v != body.Version
+	ollamaVersion.v = body.Version
+	ollamaVersion.Unlock()
+
+	if changed {
+		log.Printf("Ollama version: %s", body.Version)
+		if compareVersions(body.Version, minOllamaVersion) < 0 {
+			log.Printf("Warning: Ollama %s is older than the minimum supported %s", body.Version, minOllamaVersion)
+		}
+	}
+}
+
+// gzipUpstreamBody reports whether a request body of n bytes should be
+// gzipped. Unlike ollamaSupports it needs the version to be known: an
+// upstream that can't decode the body would reject every large request.
+// UPSTREAM_GZIP_MIN_VERSION names the first version (of Ollama, or of
+// whatever proxy reports it) that decodes gzip bodies; unset, any detected
+// version counts.
+func gzipUpstreamBody(n int) bool {
+	if gzipMinBytes <= 0 || n < gzipMinBytes {
+		return false
+	}
+	v := detectedOllamaVersion()
+	return v != "" && (gzipMinVersion == "" || compareVersions(v, gzipMinVersion) >= 0)
+}
+
+// ollamaSupports reports whether the detected Ollama has the feature. While
+// the version is unknown everything is assumed supported.
+func ollamaSupports(feature string) bool {
+	v, min := detectedOllamaVersion(), ollamaFeatureVersions[feature]
+	return v == "" || min == "" || compareVersions(v, min) >= 0
+}
+
+// compareVersions compares dotted versions like "0.5.7" numerically,
+// ignoring a leading "v" and any pre-release or build suffix.
+func compareVersions(a, b string) int {
+	parse := func(s string) []int {
+		s = strings.TrimPrefix(s, "v")
+		if i := strings.IndexAny(s, "-+"); i >= 0 {
+			s = s[:i]
+		}
+		var parts []int
+		for _, p := range strings.Split(s, ".") {
+			n, _ := strconv.Atoi(p)
+			parts = append(parts, n)
+		}
+		return parts
+	}
+	pa, pb := parse(a), parse(b)
+	for i := 0; i < max(len(pa), len(pb)); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			return cmp.Compare(x, y)
+		}
+	}
+	return 0
+}
+
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !acquireSSE(w) {
+		return
+	}
+	defer releaseSSE()
+	sse := newSSEWriter(w)
+	snapshot, ch := events.subscribe()
+	defer events.unsubscribe(ch)
+	ctx, cancel := streamContext(r)
+	defer cancel()
+
+	for _, event := range snapshot {
+		sse.send(event)
+	}
+	sse.flush()
+
+	for {
+		select {
+		case event := <-ch:
+			sse.send(event)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// streamContext returns r's context, also cancelled once the server starts
+// shutting down. srv.Shutdown never cancels request contexts, so a stream
+// that lasts until the client leaves would otherwise hold up the drain until
+// its timeout.
+func streamContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(r.Context())
+	closing := shuttingDown
+	go func() {
+		select {
+		case <-closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// generationQueue applies MAX_CONCURRENT_GENERATIONS. Unlike pulls, waiting
+// generations are served in arrival order, so each can be told its place.
+type generationQueue struct {
+	sync.Mutex
+	limit   int
+	active  int
+	waiting []*queueTicket
+}
+
+// queueTicket is one generation's claim on a slot. ready is closed once it
+// holds one; moved is signalled whenever it advances in the queue.
+type queueTicket struct {
+	ready chan struct{}
+	moved chan struct{}
+}
+
+var generations generationQueue
+
+// enter takes a slot if one is free (or there is no limit), otherwise joins
+// the back of the queue.
+func (q *generationQueue) enter() *queueTicket {
+	t := &queueTicket{ready: make(chan struct{}), moved: make(chan struct{}, 1)}
+	q.Lock()
+	defer q.Unlock()
+	if q.limit <= 0 || q.active < q.limit && len(q.waiting) == 0 {
+		q.active++
+		close(t.ready)
+	} else {
+		q.waiting = append(q.waiting, t)
+	}
+	return t
+}
+
+// position is t's 1-based place in the queue, or 0 once it holds a slot.
+func (q *generationQueue) position(t *queueTicket) int {
+	q.Lock()
+	defer q.Unlock()
+	return slices.Index(q.waiting, t) + 1
+}
+
+// leave gives up t's place in the queue, or its slot, which goes to the
+// next in line.
+func (q *generationQueue) leave(t *queueTicket) {
+	q.Lock()
+	defer q.Unlock()
+	if i := slices.Index(q.waiting, t); i >= 0 {
+		q.waiting = slices.Delete(q.waiting, i, i+1)
+		q.notify(i)
+		return
+	}
+	q.active--
+	if len(q.waiting) > 0 && (q.limit <= 0 || q.active < q.limit) {
+		next := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.active++
+		close(next.ready)
+		q.notify(0)
+	}
+}
+
+// notify tells the waiters from index from on that they moved up. Callers
+// hold the lock.
+func (q *generationQueue) notify(from int) {
+	for _, t := range q.waiting[from:] {
+		select {
+		case t.moved <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// tokenBudgetState counts tokens generated in the current window against a
+// limit; zero means unlimited. A generation already running when the budget
+// runs out is allowed to finish; only new ones are refused until the window
+// rolls over.
+type tokenBudgetState struct {
+	sync.Mutex
+	limit  int
+	period time.Duration
+	window time.Time
+	used   int
+}
+
+// tokenBudget applies HOURLY_TOKEN_BUDGET across all clients, in clock hours.
+var tokenBudget tokenBudgetState
+
+// roll starts a fresh window once the period changes. Callers hold the lock.
+func (b *tokenBudgetState) roll(now time.Time) {
+	if w := now.Truncate(b.period); !w.Equal(b.window) {
+		b.window = w
+		b.used = 0
+	}
+}
+
+// allow reports whether a new generation may start and, if not, when the
+// current window resets.
+func (b *tokenBudgetState) allow(now time.Time) (time.Time, bool) {
+	if b.limit <= 0 {
+		return time.Time{}, true
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.roll(now)
+	return b.window.Add(b.period), b.used < b.limit
+}
+
+func (b *tokenBudgetState) add(now time.Time, tokens int) {
+	b.Lock()
+	defer b.Unlock()
+	b.roll(now)
+	b.used += tokens
+}
+
+func (b *tokenBudgetState) remaining(now time.Time) int {
+	b.Lock()
+	defer b.Unlock()
+	b.roll(now)
+	return max(b.limit-b.used, 0)
+}
+
+// expired reports whether the window the budget was last used in is over.
+func (b *tokenBudgetState) expired(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	return !now.Before(b.window.Add(b.period))
+}
+
+// usage returns the tokens used in the current window and when it resets.
+func (b *tokenBudgetState) usage(now time.Time) (int, time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	b.roll(now)
+	return b.used, b.window.Add(b.period)
+}
+
+// clientQuotas holds a CLIENT_TOKEN_QUOTA budget per client identity.
+var clientQuotas = struct {
+	sync.Mutex
+	m map[string]*tokenBudgetState
+}{m: make(map[string]*tokenBudgetState)}
+
+// clientIdentity is who a quota is charged to: the remote IP. A bearer
+// token would only be a fair key if it were checked, and the one token the
+// server checks, API_TOKEN, is shared; an unchecked one could be changed on
+// every request for a fresh quota.
+func clientIdentity(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// clientQuota returns the caller's budget. Adding a client first drops
+// those whose window has run out, since they would start from zero anyway.
+func clientQuota(r *http.Request) *tokenBudgetState {
+	id := clientIdentity(r)
+	clientQuotas.Lock()
+	defer clientQuotas.Unlock()
+	q, ok := clientQuotas.m[id]
+	if !ok {
+		now := time.Now()
+		maps.DeleteFunc(clientQuotas.m, func(_ string, b *tokenBudgetState) bool {
+			return b.expired(now)
+		})
+		q = &tokenBudgetState{limit: clientTokenQuota, period: clientQuotaWindow, window: now.Truncate(clientQuotaWindow)}
+		clientQuotas.m[id] = q
+	}
+	return q
+}
+
+// addTokens charges a finished generation to the global budget and the
+// client's quota.
+func addTokens(r *http.Request, tokens int) {
+	now := time.Now()
+	tokenBudget.add(now, tokens)
+	if clientTokenQuota > 0 {
+		clientQuota(r).add(now, tokens)
+	}
+}
+
+// QuotaStatus is the caller's allowance as reported by /api/quota.
+type QuotaStatus struct {
+	Client    string     `json:"client"`
+	Limited   bool       `json:"limited"`
+	Quota     int        `json:"quota"`
+	Used      int        `json:"used"`
+	Remaining int        `json:"remaining"`
+	ResetsAt  *time.Time `json:"resets_at,omitempty"`
+}
+
+// handleConfig reports the settings the server is running with. Like the
+// startup log, it never shows secrets.
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	if !requireToken(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"config_file": configFile,
+		"settings":    effectiveConfig(),
+	})
+}
+
+func handleQuota(w http.ResponseWriter, r *http.Request) {
+	status := QuotaStatus{Client: clientIdentity(r), Limited: clientTokenQuota > 0}
+	if status.Limited {
+		q := clientQuota(r)
+		used, reset := q.usage(time.Now())
+		status.Quota, status.Used, status.Remaining, status.ResetsAt = clientTokenQuota, used, max(clientTokenQuota-used, 0), &reset
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// acquirePullSlot applies MAX_CONCURRENT_PULLS. Pulls are network and disk
+// bound, so they are limited separately from generations. Depending on
+// PULL_LIMIT_MODE a pull beyond the limit either waits for a slot or is
+// rejected with 429. It reports whether a slot was taken.
+func acquirePullSlot(w http.ResponseWriter, r *http.Request) bool {
+	select {
+	case pullSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if !pullQueueWhenFull {
+		http.Error(w, "Too many concurrent pulls", http.StatusTooManyRequests)
+		return false
+	}
+	select {
+	case pullSlots <- struct{}{}:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func modelAction(w http.ResponseWriter, r *http.Request, client *http.Client, method, url, model string) {
+	payload := OllamaModelActionPayload{Model: model}
+	data, _ := json.Marshal(payload)
+
+	ctx, span := startSpan(r.Context(), "ollama "+url[strings.LastIndex(url, "/")+1:], spanKindClient)
+	defer span.end()
+	span.setAttr("webolla.model", model)
+
+	req, _ := newUpstreamRequest(ctx, method, url, bytes.NewReader(data))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	w.Write(body)
+}
+
+// streamPull runs a pull for the pull action, relaying Ollama's progress as
+// NDJSON along with a "retrying" line before each retry. A pull that fails
+// before any progress gets an HTTP error; after that the error goes in the
+// stream, the way Ollama reports it.
+func streamPull(w http.ResponseWriter, r *http.Request, model string) {
+	ctx, span := startSpan(r.Context(), "ollama pull", spanKindClient)
+	defer span.end()
+	span.setAttr("webolla.model", model)
+
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	started := false
+	write := func(v interface{}) {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			started = true
+		}
+		_ = enc.Encode(v)
+		_ = rc.Flush()
+	}
+
+	err := pullModel(ctx, model, func(p OllamaPullProgress) { write(p) }, func(retry PullRetry) { write(retry) })
+	var urlErr *url.Error
+	switch {
+	case err == nil:
+	case !started && errors.As(err, &urlErr):
+		writeUpstreamError(w, err)
+	case !started:
+		message, _ := explainUpstreamError(err.Error())
+		http.Error(w, message, http.StatusBadGateway)
+	default:
+		write(map[string]string{"error": err.Error()})
+	}
+}
+
+// copyAction copies a model under a new name through Ollama's /api/copy.
+// Ollama's own 4xx answers, such as an unknown source, are passed on with
+// their status; anything worse is a 502.
+func copyAction(w http.ResponseWriter, r *http.Request, source, destination string) {
+	if source == "" || destination == "" {
+		writeJSONError(w, http.StatusBadRequest, "model and destination are required", "")
+		return
+	}
+
+	ctx, span := startSpan(r.Context(), "ollama copy", spanKindClient)
+	defer span.end()
+	span.setAttr("webolla.model", source)
+
+	err := copyModel(ctx, source, destination)
+	var upstream *modelRequestError
+	switch {
+	case err == nil:
+		log.Printf("Copied %s to %s for %s", source, destination, r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"source": source, "destination": destination})
+	case !errors.As(err, &upstream):
+		writeUpstreamJSONError(w, err)
+	case upstream.status < 500:
+		writeJSONError(w, upstream.status, upstream.Error(), "")
+	default:
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("copy returned %d", upstream.status), upstream.message)
+	}
+}
+
+// copyModel and deleteModel make Ollama's copy and delete calls, turning
+// a non-200 reply into an error.
+func copyModel(ctx context.Context, from, to string) error {
+	data, _ := json.Marshal(map[string]string{"source": from, "destination": to})
+	req, _ := newUpstreamRequest(ctx, http.MethodPost, ollamaCopyAPI, bytes.NewReader(data))
+	return doModelRequest(req)
+}
+
+func deleteModel(ctx context.Context, model string) error {
+	data, _ := json.Marshal(OllamaModelActionPayload{Model: model})
+	req, _ := newUpstreamRequest(ctx, http.MethodDelete, ollamaDeleteAPI, bytes.NewReader(data))
+	return doModelRequest(req)
+}
+
+// modelRequestError is a non-200 reply to a copy or delete, with Ollama's
+// error message if it sent one.
+type modelRequestError struct {
+	status  int
+	message string
+	path    string
+}
+
+func (e *modelRequestError) Error() string {
+	if e.message != "" {
+		return e.message
+	}
+	return fmt.Sprintf("%s returned %d %s", e.path, e.status, http.StatusText(e.status))
+}
+
+func doModelRequest(req *http.Request) error {
+	resp, err := deleteClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&body)
+	return &modelRequestError{status: resp.StatusCode, message: body.Error, path: req.URL.Path}
+}
+
+// fullModelName adds the implied ":latest" tag, the way /api/tags lists it.
+func fullModelName(name string) string {
+	if !strings.Contains(name, ":") {
+		return name + ":latest"
+	}
+	return name
+}
+
+type RenameResult struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Renamed bool   `json:"renamed"`
+	Warning string `json:"warning,omitempty"`
+}
+
+// handleRenameModel renames a model by copying it, checking the copy is
+// listed, and deleting the original. If that last delete fails both names
+// remain, and the reply says so rather than reporting an error. It needs
+// both the copy and delete actions enabled.
+func handleRenameModel(w http.ResponseWriter, r *http.Request) {
+	if !actionAllowed(w, "copy") || !actionAllowed(w, "delete") {
+		return
+	}
+
+	var req struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, to := fullModelName(strings.TrimSpace(req.From)), fullModelName(strings.TrimSpace(req.To))
+	if req.From == "" || req.To == "" || from == to {
+		http.Error(w, "from and to must be two different model names", http.StatusBadRequest)
+		return
+	}
+
+	installed := func() (map[string]bool, error) {
+		tags, err := fetchTags(r.Context())
+		if err != nil {
+			return nil, err
+		}
+		names := make(map[string]bool)
+		for _, m := range tags.Models {
+			names[m.Name] = true
+		}
+		return names, nil
+	}
+
+	names, err := installed()
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	if !names[from] {
+		http.Error(w, fmt.Sprintf("Model %s is not installed", from), http.StatusNotFound)
+		return
+	}
+	if names[to] {
+		http.Error(w, fmt.Sprintf("Model %s already exists", to), http.StatusConflict)
+		return
+	}
+
+	if err := copyModel(r.Context(), from, to); err != nil {
+		message, detail := explainUpstreamError(err.Error())
+		writeJSONError(w, http.StatusBadGateway, "Copy failed: "+message, detail)
+		return
+	}
+	if names, err = installed(); err != nil || !names[to] {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Copy to %s did not show up in the model list; %s was left in place", to, from), "")
+		return
+	}
+
+	result := RenameResult{From: from, To: to, Renamed: true}
+	if err := deleteModel(r.Context(), from); err != nil {
+		log.Printf("Rename %s -> %s: delete of the original failed: %v", from, to, err)
+		result.Renamed = false
+		result.Warning = fmt.Sprintf("Copied to %s, but deleting %s failed (%v); both names now exist.", to, from, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// handleListModels returns installed models, most recently modified first.
+// An optional ?limit=N trims the list; total is always the full count.
+// ?group=family nests the tags of each base model under one entry.
+func handleListModels(w http.ResponseWriter, r *http.Request) {
+	group := r.URL.Query().Get("group")
+	if group != "" && group != "family" {
+		writeJSONError(w, http.StatusBadRequest, "group must be family", "")
+		return
+	}
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be a non-negative integer", "")
+			return
+		}
+		limit = n
+	}
+
+	ctx, span := startSpan(r.Context(), "ollama tags", spanKindClient)
+	defer span.end()
+
+	var models []OllamaModel
+	var err error
+	if len(ollamaBackends) > 1 {
+		models, err = fetchAllTags(ctx)
+	} else {
+		var tags *OllamaTagsResponse
+		if tags, err = fetchTags(ctx); err == nil {
+			models = tags.Models
+		}
+	}
+	if err != nil {
+		writeUpstreamJSONError(w, err)
+		return
+	}
+
+	sort.SliceStable(models, func(i, j int) bool {
+		return models[i].ModifiedAt.After(models[j].ModifiedAt)
+	})
+	total := len(models)
+	if limit > 0 && limit < total {
+		models = models[:limit]
+	}
+	if models == nil {
+		models = []OllamaModel{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if group == "family" {
+		_ = json.NewEncoder(w).Encode(ModelGroupsResponse{Groups: groupModels(models), Total: total})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(ModelListResponse{Models: models, Total: total})
+}
+
+// ModelGroup is one base model and its installed tags.
+type ModelGroup struct {
+	Name   string        `json:"name"`
+	Family string        `json:"family,omitempty"`
+	Models []OllamaModel `json:"models"`
+}
+
+type ModelGroupsResponse struct {
+	Groups []ModelGroup `json:"groups"`
+	Total  int          `json:"total"`
+}
+
+// groupModels nests models by base name, the part before the tag, so
+// llama3:8b and llama3:70b land together. Family is the details family the
+// tags report, when they agree on one. Groups keep the order of their first
+// model.
+func groupModels(models []OllamaModel) []ModelGroup {
+	groups := []ModelGroup{}
+	index := make(map[string]int)
+	for _, m := range models {
+		base, _, _ := strings.Cut(m.Name, ":")
+		i, ok := index[base]
+		if !ok {
+			i = len(groups)
+			index[base] = i
+			groups = append(groups, ModelGroup{Name: base, Family: m.Details.Family})
+		}
+		g := &groups[i]
+		if g.Family != m.Details.Family {
+			g.Family = ""
+		}
+		g.Models = append(g.Models, m)
+	}
+	return groups
+}
+
+// fetchTags lists the installed models.
+func fetchTags(ctx context.Context) (*OllamaTagsResponse, error) {
+	return fetchTagsFrom(ctx, ollamaTagsAPI)
+}
+
+// fetchAllTags lists the models of every backend, one entry per name with
+// the backends that have it. Metadata comes from the first backend in
+// OLLAMA_BACKENDS order. A backend that can't be listed is skipped; only
+// when none can is it an error.
+func fetchAllTags(ctx context.Context) ([]OllamaModel, error) {
+	results := make([]*OllamaTagsResponse, len(ollamaBackends))
+	errs := make([]error, len(ollamaBackends))
+	var wg sync.WaitGroup
+	for i, b := range ollamaBackends {
+		wg.Go(func() {
+			results[i], errs[i] = fetchTagsFrom(ctx, b+"/api/tags")
+		})
+	}
+	wg.Wait()
+
+	var models []OllamaModel
+	index := make(map[string]int)
+	for i, tags := range results {
+		if errs[i] != nil {
+			log.Printf("Listing models on %s failed: %v", redactURL(ollamaBackends[i]), errs[i])
+			continue
+		}
+		backend := redactURL(ollamaBackends[i])
+		for _, m := range tags.Models {
+			if j, ok := index[m.Name]; ok {
+				models[j].Backends = append(models[j].Backends, backend)
+				continue
+			}
+			m.Backends = []string{backend}
+			index[m.Name] = len(models)
+			models = append(models, m)
+		}
+	}
+	if models == nil {
+		if err := errors.Join(errs...); err != nil {
+			return nil, err
+		}
+	}
+	return models, nil
+}
+
+func fetchTagsFrom(ctx context.Context, tagsURL string) (*OllamaTagsResponse, error) {
+	req, _ := newUpstreamRequest(ctx, http.MethodGet, tagsURL, nil)
+	resp, err := listClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tags returned %s", resp.Status)
+	}
+
+	var tags OllamaTagsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return nil, err
+	}
+	return &tags, nil
+}
+
+// RunningModel is one entry of /api/ps: a model currently loaded.
+type RunningModel struct {
+	Name      string    `json:"name"`
+	Model     string    `json:"model"`
+	Size      int64     `json:"size"`
+	SizeVRAM  int64     `json:"size_vram"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// ExpiresIn counts down to ExpiresAt, e.g. "4m12s", or is "never" for
+	// a model loaded with a negative keep_alive.
+	ExpiresIn string `json:"expires_in"`
+}
+
+// neverExpires is how far out an expiry has to be to count as never. Ollama
+// stores a negative keep_alive as an expiry centuries away.
+const neverExpires = 100 * 365 * 24 * time.Hour
+
+func expiresIn(at, now time.Time) string {
+	switch {
+	case at.IsZero() || at.Sub(now) > neverExpires:
+		return "never"
+	case !at.After(now):
+		return "0s"
+	}
+	return at.Sub(now).Round(time.Second).String()
+}
+
+func fetchRunning(ctx context.Context) ([]RunningModel, error) {
+	req, _ := newUpstreamRequest(ctx, http.MethodGet, ollamaPsAPI, nil)
+	resp, err := listClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ps returned %s", resp.Status)
+	}
+
+	var ps struct {
+		Models []RunningModel `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ps); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for i := range ps.Models {
+		ps.Models[i].ExpiresIn = expiresIn(ps.Models[i].ExpiresAt, now)
+	}
+	return ps.Models, nil
+}
+
+// VramFit is the answer from /api/models/fit.
+type VramFit struct {
+	Model     string `json:"model"`
+	Size      uint64 `json:"size"`
+	VramTotal uint64 `json:"vram_total"`
+	VramFree  uint64 `json:"vram_free"`
+	Loaded    bool   `json:"loaded"`
+	// Reclaimable is VRAM held by other loaded models, which Ollama can
+	// unload to make room.
+	Reclaimable     uint64 `json:"reclaimable"`
+	Fits            bool   `json:"fits"`
+	FitsAfterUnload bool   `json:"fits_after_unload"`
+}
+
+// vramFit works out whether a model of size bytes can load right now. It
+// goes by free VRAM, not the card total; when the GPU doesn't report usage,
+// the VRAM held by loaded models stands in for it. A model that is already
+// loaded always fits.
+func vramFit(model string, size uint64, stats GpuStats, running []RunningModel) VramFit {
+	fit := VramFit{Model: model, Size: size, VramTotal: stats.VramTotal}
+
+	var loadedVRAM uint64
+	for _, m := range running {
+		loadedVRAM += uint64(max(m.SizeVRAM, 0))
+		if m.Name == model {
+			fit.Loaded = true
+			continue
+		}
+		fit.Reclaimable += uint64(max(m.SizeVRAM, 0))
+	}
+	used := stats.VramUsed
+	if used == 0 {
+		used = loadedVRAM
+	}
+	if fit.VramTotal > used {
+		fit.VramFree = fit.VramTotal - used
+	}
+
+	fit.Fits = fit.Loaded || size <= fit.VramFree
+	fit.FitsAfterUnload = fit.Fits || size <= fit.VramFree+fit.Reclaimable
+	return fit
+}
+
+func handleModelFit(w http.ResponseWriter, r *http.Request) {
+	model := fullModelName(r.URL.Query().Get("model"))
+	if model == ":latest" {
+		http.Error(w, "model is required", http.StatusBadRequest)
+		return
+	}
+
+	size, stats, running, ok := loadFitInputs(w, r, model)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(vramFit(model, size, stats, running))
+}
+
+// loadFitInputs gathers what a VRAM check needs: the model's size on disk,
+// the GPU stats (with GPU_VRAM_TOTAL_MB standing in for a missing total)
+// and the loaded models. On failure it has already answered the request.
+func loadFitInputs(w http.ResponseWriter, r *http.Request, model string) (uint64, GpuStats, []RunningModel, bool) {
+	stats := getArcStats()
+	if stats.VramTotal == 0 {
+		stats.VramTotal = gpuVramTotal
+	}
+	if stats.VramTotal == 0 {
+		http.Error(w, "VRAM size unknown: no GPU telemetry and GPU_VRAM_TOTAL_MB unset", http.StatusServiceUnavailable)
+		return 0, stats, nil, false
+	}
+
+	tags, err := fetchTags(r.Context())
+	if err != nil {
+		writeUpstreamError(w, err)
+		return 0, stats, nil, false
+	}
+	idx := slices.IndexFunc(tags.Models, func(m OllamaModel) bool { return m.Name == model })
+	if idx < 0 {
+		http.Error(w, fmt.Sprintf("Model %s is not installed", model), http.StatusNotFound)
+		return 0, stats, nil, false
+	}
+	running, err := fetchRunning(r.Context())
+	if err != nil {
+		writeUpstreamError(w, err)
+		return 0, stats, nil, false
+	}
+	return uint64(max(tags.Models[idx].Size, 0)), stats, running, true
+}
+
+// defaultNumCtx is Ollama's context length when a request doesn't set one.
+const defaultNumCtx = 2048
+
+// EstimateResponse is the answer from /api/estimate; see kvCacheBytes for
+// how approximate it is.
+type EstimateResponse struct {
+	Model         string `json:"model"`
+	NumCtx        int    `json:"num_ctx"`
+	WeightsBytes  uint64 `json:"weights_bytes"`
+	KVCacheBytes  uint64 `json:"kv_cache_bytes"`
+	RequiredBytes uint64 `json:"required_bytes"`
+	FreeBytes     uint64 `json:"free_bytes"`
+	Fits          bool   `json:"fits"`
+}
+
+// kvCacheBytes estimates the f16 KV cache for numCtx tokens from the model's
+// architecture in /api/show: keys and values for every layer, each
+// head_count_kv heads of embedding_length/head_count. Quantized caches,
+// compute buffers and runtime overhead are not counted, so treat the result
+// as a rough lower bound.
+func kvCacheBytes(modelInfo map[string]interface{}, numCtx int) (uint64, error) {
+	arch, _ := modelInfo["general.architecture"].(string)
+	num := func(key string) uint64 {
+		v, _ := modelInfo[arch+"."+key].(float64)
+		return uint64(max(v, 0))
+	}
+	layers, embedding, heads := num("block_count"), num("embedding_length"), num("attention.head_count")
+	if arch == "" || layers == 0 || embedding == 0 || heads == 0 {
+		return 0, errors.New("model_info lacks the architecture needed to estimate the KV cache")
+	}
+	kvHeads := num("attention.head_count_kv")
+	if kvHeads == 0 {
+		kvHeads = heads
+	}
+	return 2 * layers * uint64(numCtx) * kvHeads * (embedding / heads) * 2, nil
+}
+
+func handleEstimate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Model  string `json:"model"`
+		NumCtx int    `json:"num_ctx"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Model == "" || req.NumCtx < 0 {
+		http.Error(w, "model is required and num_ctx must not be negative", http.StatusBadRequest)
+		return
+	}
+	model := fullModelName(req.Model)
+	numCtx := cmp.Or(req.NumCtx, defaultNumCtx)
+
+	size, stats, running, ok := loadFitInputs(w, r, model)
+	if !ok {
+		return
+	}
+	var show struct {
+		ModelInfo map[string]interface{} `json:"model_info"`
+	}
+	if err := showModel(r.Context(), model, &show); err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	kv, err := kvCacheBytes(show.ModelInfo, numCtx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Loading with a new context length replaces the model's current
+	// instance, so the VRAM that holds counts as free.
+	free := vramFit(model, 0, stats, running).VramFree
+	for _, m := range running {
+		if m.Name == model {
+			free += uint64(max(m.SizeVRAM, 0))
+		}
+	}
+	required := size + kv
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(EstimateResponse{
+		Model:         model,
+		NumCtx:        numCtx,
+		WeightsBytes:  size,
+		KVCacheBytes:  kv,
+		RequiredBytes: required,
+		FreeBytes:     free,
+		Fits:          required <= free,
+	})
+}
+
+type DiskUsage struct {
+	Path       string           `json:"path"`
+	TotalBytes int64            `json:"total_bytes"`
+	Models     []ModelDiskUsage `json:"models"`
+	Errors     []string         `json:"errors,omitempty"`
+}
+
+type ModelDiskUsage struct {
+	Name   string `json:"name"`
+	Bytes  int64  `json:"bytes"`
+	InTags bool   `json:"in_tags"`
+}
+
+type ollamaManifest struct {
+	Config struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Layers []struct {
+		Digest string `json:"digest"`
+	} `json:"layers"`
+}
+
+func handleDiskUsage(w http.ResponseWriter, r *http.Request) {
+	usage := diskUsage(ollamaModelsDir)
+
+	if tags, err := fetchTags(r.Context()); err != nil {
+		usage.Errors = append(usage.Errors, "could not cross-reference /api/tags: "+err.Error())
+	} else {
+		installed := make(map[string]bool)
+		for _, m := range tags.Models {
+			installed[m.Name] = true
+		}
+		for i := range usage.Models {
+			usage.Models[i].InTags = installed[usage.Models[i].Name]
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(usage)
+}
+
+// diskUsage walks an Ollama models directory. The total counts every file;
+// per-model sizes sum the blobs referenced by each manifest, so blobs shared
+// between models are counted once per model. Unreadable paths are reported
+// in Errors rather than failing the whole walk.
+func diskUsage(root string) DiskUsage {
+	usage := DiskUsage{Path: root, Models: []ModelDiskUsage{}}
+
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			usage.Errors = append(usage.Errors, err.Error())
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			usage.TotalBytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		usage.Errors = append(usage.Errors, err.Error())
+	}
+
+	manifests := filepath.Join(root, "manifests")
+	_ = filepath.WalkDir(manifests, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(manifests, path)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			usage.Errors = append(usage.Errors, err.Error())
+			return nil
+		}
+		var m ollamaManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			usage.Errors = append(usage.Errors, fmt.Sprintf("%s: %v", rel, err))
+			return nil
+		}
+
+		digests := []string{m.Config.Digest}
+		for _, l := range m.Layers {
+			digests = append(digests, l.Digest)
+		}
+		var size int64
+		for _, digest := range digests {
+			blob := filepath.Join(root, "blobs", strings.Replace(digest, ":", "-", 1))
+			if info, err := os.Stat(blob); err == nil {
+				size += info.Size()
+			}
+		}
+		usage.Models = append(usage.Models, ModelDiskUsage{Name: manifestModelName(rel), Bytes: size})
+		return nil
+	})
+
+	return usage
+}
+
+// manifestModelName turns a manifest path such as
+// registry.ollama.ai/library/llama3/8b into the name Ollama lists ("llama3:8b").
+func manifestModelName(rel string) string {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) < 2 {
+		return rel
+	}
+	name := strings.Join(parts[:len(parts)-1], "/") + ":" + parts[len(parts)-1]
+	name = strings.TrimPrefix(name, "registry.ollama.ai/")
+	return strings.TrimPrefix(name, "library/")
+}
+
+// modelCatalog is a short list of popular tags from the Ollama library,
+// offered as pull suggestions alongside whatever is already installed.
+var modelCatalog = []string{
+	"llama3.2:1b", "llama3.2:3b", "llama3.1:8b", "llama3.1:70b", "llama3:8b",
+	"mistral:7b", "mistral-nemo:12b", "mixtral:8x7b",
+	"gemma2:2b", "gemma2:9b", "gemma3:1b", "gemma3:4b", "gemma3:12b",
+	"qwen2.5:0.5b", "qwen2.5:1.5b", "qwen2.5:7b", "qwen2.5:14b", "qwen2.5-coder:7b",
+	"qwen3:4b", "qwen3:8b", "qwen3:14b",
+	"phi3:mini", "phi3:medium", "phi4:14b",
+	"deepseek-r1:1.5b", "deepseek-r1:7b", "deepseek-r1:8b", "deepseek-r1:14b",
+	"codellama:7b", "codellama:13b", "starcoder2:3b", "starcoder2:7b",
+	"llava:7b", "llava:13b", "moondream:1.8b",
+	"tinyllama:1.1b", "smollm2:1.7b",
+	"nomic-embed-text:latest", "mxbai-embed-large:latest",
+}
+
+const (
+	completeDefaultLimit = 10
+	completeMaxLimit     = 50
+)
+
+type ModelSuggestion struct {
+	Name      string `json:"name"`
+	Installed bool   `json:"installed"`
+}
+
+// handleComplete suggests model tags for ?prefix= from the catalog and the
+// installed models. If Ollama can't be reached the catalog alone is used.
+func handleComplete(w http.ResponseWriter, r *http.Request) {
+	limit := completeDefaultLimit
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = min(n, completeMaxLimit)
+	}
+
+	var installed []string
+	if tags, err := fetchTags(r.Context()); err == nil {
+		for _, m := range tags.Models {
+			installed = append(installed, m.Name)
+		}
+	}
+
+	suggestions := completeModels(r.URL.Query().Get("prefix"), modelCatalog, installed)
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(suggestions)
+}
+
+// completeModels ranks names matching prefix: an exact match first, then
+// names starting with it, then names where it starts a later part of the
+// name (after ':', '-', '.' or '/'), then any other substring match.
+// Within a rank installed models come first, then shorter names.
+func completeModels(prefix string, catalog, installed []string) []ModelSuggestion {
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+	rank := func(name string) int {
+		name = strings.ToLower(name)
+		switch {
+		case name == prefix:
+			return 0
+		case strings.HasPrefix(name, prefix):
+			return 1
+		}
+		i := strings.Index(name, prefix)
+		switch {
+		case i > 0 && strings.ContainsRune(":-./", rune(name[i-1])):
+			return 2
+		case i > 0:
+			return 3
+		}
+		return -1
+	}
+
+	isInstalled := make(map[string]bool)
+	for _, name := range installed {
+		isInstalled[name] = true
+	}
+	seen := make(map[string]bool)
+	out := []ModelSuggestion{}
+	for _, name := range slices.Concat(installed, catalog) {
+		if seen[name] || rank(name) < 0 {
+			continue
+		}
+		seen[name] = true
+		out = append(out, ModelSuggestion{Name: name, Installed: isInstalled[name]})
+	}
+
+	slices.SortStableFunc(out, func(a, b ModelSuggestion) int {
+		if c := cmp.Compare(rank(a.Name), rank(b.Name)); c != 0 {
+			return c
+		}
+		if a.Installed != b.Installed {
+			if a.Installed {
+				return -1
+			}
+			return 1
+		}
+		if c := cmp.Compare(len(a.Name), len(b.Name)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return out
+}
+
+type ModelfileIssue struct {
+	Line  int    `json:"line"`
+	Issue string `json:"issue"`
+}
+
+type ModelfileValidation struct {
+	Valid  bool             `json:"valid"`
+	Errors []ModelfileIssue `json:"errors"`
+}
+
+// modelfileParameters maps the PARAMETER names Ollama accepts to whether
+// their value must be numeric.
+var modelfileParameters = map[string]bool{
+	"mirostat": true, "mirostat_eta": true, "mirostat_tau": true,
+	"num_ctx": true, "num_gpu": true, "num_thread": true, "num_predict": true,
+	"repeat_last_n": true, "repeat_penalty": true, "temperature": true,
+	"seed": true, "tfs_z": true, "top_k": true, "top_p": true, "min_p": true,
+	"stop": false,
+}
+
+func handleValidateModelfile(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Modelfile string `json:"modelfile"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	issues := validateModelfile(req.Modelfile)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(ModelfileValidation{Valid: len(issues) == 0, Errors: issues})
+}
+
+// validateModelfile does a lightweight syntax check of a Modelfile. It knows
+// the instruction set and the shape of each instruction's arguments, not
+// whether the base model or adapter exists; Ollama still has the final say
+// on create. Line 0 marks issues with the file as a whole.
+func validateModelfile(src string) []ModelfileIssue {
+	issues := []ModelfileIssue{}
+	report := func(line int, format string, args ...interface{}) {
+		issues = append(issues, ModelfileIssue{Line: line, Issue: fmt.Sprintf(format, args...)})
+	}
+
+	lines := strings.Split(src, "\n")
+	fromLine := 0
+	for i := 0; i < len(lines); i++ {
+		n := i + 1
+		line := strings.TrimSpace(lines[i])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		instruction, args := cutSpace(line)
+
+		// A """ value may span lines; fold them in so the checks below
+		// see the whole argument.
+		if strings.Contains(args, `"""`) && strings.Count(args, `"""`)%2 == 1 {
+			closed := false
+			for i+1 < len(lines) {
+				i++
+				args += "\n" + lines[i]
+				if strings.Contains(lines[i], `"""`) {
+					closed = true
+					break
+				}
+			}
+			if !closed {
+				report(n, `unterminated """ block`)
+				continue
+			}
+		}
+
+		if args == "" {
+			report(n, "%s needs an argument", strings.ToUpper(instruction))
+			continue
+		}
+
+		switch strings.ToUpper(instruction) {
+		case "FROM":
+			if fromLine != 0 {
+				report(n, "duplicate FROM (first on line %d)", fromLine)
+			}
+			fromLine = n
+		case "PARAMETER":
+			name, value := cutSpace(args)
+			numeric, known := modelfileParameters[strings.ToLower(name)]
+			switch {
+			case !known:
+				report(n, "unknown parameter %q", name)
+			case value == "":
+				report(n, "parameter %q needs a value", name)
+			case numeric:
+				if _, err := strconv.ParseFloat(value, 64); err != nil {
+					report(n, "parameter %q must be a number, got %q", name, value)
+				}
+			}
+		case "MESSAGE":
+			role, _ := cutSpace(args)
+			if role != "system" && role != "user" && role != "assistant" {
+				report(n, "MESSAGE role must be system, user or assistant, got %q", role)
+			}
+		case "TEMPLATE", "SYSTEM", "ADAPTER", "LICENSE":
+		default:
+			report(n, "unknown instruction %q", instruction)
+		}
+	}
+
+	if fromLine == 0 {
+		report(0, "missing FROM")
+	}
+	return issues
+}
+
+// cutSpace splits s at its first run of whitespace, so tabs and repeated
+// spaces separate Modelfile words the way a single space does.
+func cutSpace(s string) (first, rest string) {
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+// upstreamErrorHints pairs fragments of Ollama error messages with a
+// plain-language explanation and what to try next. The first match wins,
+// so more specific fragments come first.
+var upstreamErrorHints = []struct{ match, explanation string }{
+	{"signal: killed", "The model runner was killed, almost always for running out of memory. Try a smaller model or a lower num_ctx."},
+	{"out of memory", "Out of VRAM. Try a smaller model or quantization, or a lower num_ctx."},
+	{"cudamalloc failed", "Out of VRAM. Try a smaller model or quantization, or a lower num_ctx."},
+	{"requires more system memory", "Not enough system RAM for this model. Try a smaller model or quantization."},
+	{"pull model manifest: file does not exist", "No such model in the registry. Check the name and tag."},
+	{"try pulling it first", "The model isn't installed. Pull it first."},
+	{"unknown model architecture", "This Ollama version doesn't support the model's architecture. Upgrade Ollama."},
+	{"llama runner process has terminated", "The model runner crashed while loading. Check the Ollama server log; the model file may be damaged or too new for this Ollama."},
+	{"does not support tools", "This model doesn't support tool calling. Pick a model with tool support or drop the tools."},
+	{"does not support generate", "This is an embedding model; it can't generate text."},
+	{"timed out waiting for llama runner to start", "The model took too long to load. It may be too large for this machine, or the disk is slow."},
+}
+
+// explainUpstreamError returns a client-facing message for an Ollama error
+// and the original text as detail. Unrecognised errors are returned as is,
+// with no detail.
+func explainUpstreamError(msg string) (message, detail string) {
+	lower := strings.ToLower(msg)
+	for _, h := range upstreamErrorHints {
+		if strings.Contains(lower, h.match) {
+			return h.explanation, msg
+		}
+	}
+	return msg, ""
+}
+
+// errorEvent is the SSE error event for a failed step of a streamed job.
+func errorEvent(err error) map[string]string {
+	message, detail := explainUpstreamError(err.Error())
+	event := map[string]string{"type": "error", "error": message}
+	if detail != "" {
+		event["detail"] = detail
+	}
+	return event
+}
+
+// writeJSONError sends {"error": message, "detail": detail} with status.
+func writeJSONError(w http.ResponseWriter, status int, message, detail string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(struct {
+		Error  string `json:"error"`
+		Detail string `json:"detail,omitempty"`
+	}{message, detail})
+}
+
+// writeUpstreamError reports a failed call to Ollama. The underlying error,
+// with the upstream URL, goes to the log; the client gets
+// OLLAMA_UNREACHABLE_MESSAGE, or a 504 if the call ran out of time (our
+// timeout or the client's X-Request-Deadline).
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	status, message := upstreamFailure(err)
+	http.Error(w, message, status)
+}
+
+// writeUpstreamJSONError is writeUpstreamError for endpoints that answer
+// in JSON.
+func writeUpstreamJSONError(w http.ResponseWriter, err error) {
+	status, message := upstreamFailure(err)
+	writeJSONError(w, status, message, "")
+}
+
+func upstreamFailure(err error) (int, string) {
+	log.Printf("Ollama request failed: %v", err)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout, "Timed out waiting for Ollama"
+	}
+	return http.StatusBadGateway, unreachableMessage
+}
+
+// newUpstreamRequest builds a request to Ollama carrying the JSON content
+// type, our User-Agent and the current trace context. Bodies of at least
+// UPSTREAM_GZIP_MIN_BYTES are gzipped when the upstream accepts that.
+func newUpstreamRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	compressed := false
+	if b, ok := body.(*bytes.Reader); ok && gzipUpstreamBody(b.Len()) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := b.WriteTo(zw); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		body, compressed = bytes.NewReader(buf.Bytes()), true
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if compressed {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	req.Header.Set("User-Agent", upstreamUserAgent)
+	if s := spanFromContext(ctx); s != nil {
+		req.Header.Set("traceparent", s.traceparent())
+	}
+	return req, nil
+}
+
+// Tracing is a small OpenTelemetry-compatible implementation: spans use W3C
+// trace context and are exported as OTLP/HTTP JSON to
+// OTEL_EXPORTER_OTLP_ENDPOINT. With the endpoint unset every span is nil and
+// all span methods are no-ops.
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+)
+
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu    sync.Mutex
+	attrs map[string]interface{}
+}
+
+type spanContextKey struct{}
+
+var finishedSpans = make(chan *finishedSpan, 1024)
+
+type finishedSpan struct {
+	*span
+	end time.Time
 }
 
-func getEnv(key, def string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if otlpEndpoint == "" {
+		return ctx, nil
 	}
-	return def
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: make(map[string]interface{})}
+	if parent := spanFromContext(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, s), s
 }
 
-type GenerationParams struct {
-	Temperature   float64 `json:"temperature"`
-	TopP          float64 `json:"top_p"`
-	TopK          int     `json:"top_k"`
-	RepeatPenalty float64 `json:"repeat_penalty"`
-	NumPredict    int     `json:"num_predict"`
+func (s *span) setAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
 }
 
-type OllamaGenerateRequestPayload struct {
-	Model   string                 `json:"model"`
-	Prompt  string                 `json:"prompt"`
-	Stream  bool                   `json:"stream"`
-	Options map[string]interface{} `json:"options,omitempty"`
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	select {
+	case finishedSpans <- &finishedSpan{span: s, end: time.Now()}:
+	default:
+		log.Printf("Tracing: export queue full, dropping span %s", s.name)
+	}
 }
 
-type OllamaChatRequestPayload struct {
-	Model    string                 `json:"model"`
-	Messages []Message              `json:"messages"`
-	Stream   bool                   `json:"stream"`
-	Options  map[string]interface{} `json:"options,omitempty"`
+func (s *span) traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", s.traceID, s.spanID)
 }
 
-type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+// parseTraceparent extracts the remote parent from a W3C traceparent header.
+func parseTraceparent(h string) *span {
+	parts := strings.Split(h, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil
+	}
+	s := &span{}
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil {
+		return nil
+	}
+	if _, err := hex.Decode(s.spanID[:], []byte(parts[2])); err != nil {
+		return nil
+	}
+	return s
 }
 
-type OllamaModelActionPayload struct {
-	Model string `json:"name"`
+// withTracing starts a server span per incoming request, continuing the
+// caller's trace when a traceparent header is present.
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if otlpEndpoint == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		if remote := parseTraceparent(r.Header.Get("traceparent")); remote != nil {
+			ctx = context.WithValue(ctx, spanContextKey{}, remote)
+		}
+		ctx, s := startSpan(ctx, r.Method+" "+r.URL.Path, spanKindServer)
+		defer s.end()
+		s.setAttr("http.method", r.Method)
+		s.setAttr("http.target", r.URL.Path)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
 }
 
-type OllamaResponseChunk struct {
-	Model    string   `json:"model"`
-	Response string   `json:"response"`
-	Message  *Message `json:"message"`
-	Done     bool     `json:"done"`
+// runSpanExporter batches finished spans and posts them to the collector.
+// Once stop is closed it sends whatever is still queued and closes done, so
+// the spans of the last requests aren't lost on exit.
+func runSpanExporter(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	var batch []*finishedSpan
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		data, _ := json.Marshal(otlpPayload(batch))
+		batch = nil
+		resp, err := client.Post(otlpEndpoint, "application/json", bytes.NewReader(data))
+		if err != nil {
+			log.Printf("Tracing: export failed: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Tracing: collector returned %s", resp.Status)
+		}
+	}
+
+	for {
+		select {
+		case s := <-finishedSpans:
+			batch = append(batch, s)
+			if len(batch) >= 128 {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-stop:
+			for {
+				select {
+				case s := <-finishedSpans:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
 }
 
-type ClientRequest struct {
-	ActionType string           `json:"actionType"`
-	Model      string           `json:"model"`
-	Prompt     string           `json:"prompt"`
-	Messages   []Message        `json:"messages"`
-	Params     GenerationParams `json:"params"`
+func otlpPayload(batch []*finishedSpan) map[string]interface{} {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		var attrs []map[string]interface{}
+		s.mu.Lock()
+		for k, v := range s.attrs {
+			val := map[string]interface{}{"stringValue": fmt.Sprint(v)}
+			if n, ok := v.(int); ok {
+				val = map[string]interface{}{"intValue": strconv.Itoa(n)}
+			}
+			attrs = append(attrs, map[string]interface{}{"key": k, "value": val})
+		}
+		s.mu.Unlock()
+
+		out := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attrs,
+		}
+		if s.parentID != [8]byte{} {
+			out["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		spans = append(spans, out)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{map[string]interface{}{
+					"key":   "service.name",
+					"value": map[string]interface{}{"stringValue": otelServiceName},
+				}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "webolla"},
+				"spans": spans,
+			}},
+		}},
+	}
 }
 
-type OllamaTagsResponse struct {
-	Models []struct {
-		Name string `json:"name"`
-	} `json:"models"`
+// GpuStats is the latest GPU telemetry sample. Fields the driver doesn't
+// expose are left zero.
+type GpuStats struct {
+	Device     string    `json:"device"`
+	TempC      float64   `json:"temp_c"`
+	PowerWatts float64   `json:"power_watts"`
+	FreqMHz    int       `json:"freq_mhz"`
+	VramUsed   uint64    `json:"vram_used"`
+	VramTotal  uint64    `json:"vram_total"`
+	VramFree   uint64    `json:"vram_free"`
+	Driver     string    `json:"driver"`
+	UpdatedAt  time.Time `json:"updated_at"`
 }
 
-type ServerStatus struct {
-	OllamaURL     string `json:"ollama_url"`
-	Connected     bool   `json:"connected"`
-	PortListening string `json:"port"`
+type telemetryProvider interface {
+	Sample() (GpuStats, error)
 }
 
-var httpClient = &http.Client{
-	Timeout: generateTimeout,
-	Transport: &http.Transport{
-		MaxIdleConns:        100,
-		MaxIdleConnsPerHost: 10,
-		IdleConnTimeout:     90 * time.Second,
-	},
+// arcProvider reads Intel Arc telemetry from sysfs under cardPath
+// (e.g. /sys/class/drm/card0). The hwmon directory and driver are discovered
+// on first use, and again after reset.
+type arcProvider struct {
+	cardPath string
+
+	mu        sync.Mutex
+	hwmonPath string
+	driver    string
+	// The previous energy1_input reading, for cards without power1_input.
+	lastEnergy   int64
+	lastEnergyAt time.Time
 }
 
-func main() {
-	http.HandleFunc("/", serveHTML)
-	http.HandleFunc("/api/ollama-action", handleOllamaAction)
-	http.HandleFunc("/api/models", handleListModels)
-	http.HandleFunc("/api/status", handleServerStatus)
+// energySampleInterval separates the two energy readings taken when there
+// is no earlier one to compare with.
+const energySampleInterval = 100 * time.Millisecond
 
-	log.Printf("Web UI: http://localhost:%s", port)
-	log.Printf("Ollama API: %s", ollamaBaseURL)
+// gpu is the provider the telemetry loop samples; /api/gpu/reset resets it.
+var gpu *arcProvider
 
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+// reset forgets the discovered paths, e.g. after a driver reload or a GPU
+// swap, so the next Sample looks them up again.
+func (p *arcProvider) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hwmonPath, p.driver = "", ""
+	p.lastEnergy, p.lastEnergyAt = 0, time.Time{}
 }
 
-func serveHTML(w http.ResponseWriter, _ *http.Request) {
-	w.Header().Set("Content-Type", "text/html")
-	fmt.Fprint(w, htmlContent)
-}
+// energyPower derives watts from energy1_input, a running total in
+// microjoules, for drivers that don't expose power1_input. It compares with
+// the previous sample's reading, or takes a second one energySampleInterval
+// later when there is none (first sample, or the counter went backwards).
+// Callers hold p.mu.
+func (p *arcProvider) energyPower() (float64, bool) {
+	path := filepath.Join(p.hwmonPath, "energy1_input")
+	energy, err := readSysfsInt(path)
+	if err != nil {
+		return 0, false
+	}
+	at := time.Now()
 
-func handleServerStatus(w http.ResponseWriter, _ *http.Request) {
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Get(ollamaTagsAPI)
+	prev, prevAt := p.lastEnergy, p.lastEnergyAt
+	if prevAt.IsZero() || energy < prev {
+		prev, prevAt = energy, at
+		time.Sleep(energySampleInterval)
+		if energy, err = readSysfsInt(path); err != nil {
+			return 0, false
+		}
+		at = time.Now()
+	}
+	p.lastEnergy, p.lastEnergyAt = energy, at
 
-	connected := err == nil && resp.StatusCode == http.StatusOK
-	if resp != nil {
-		resp.Body.Close()
+	elapsed := at.Sub(prevAt).Seconds()
+	if elapsed <= 0 || energy < prev {
+		return 0, false
 	}
+	return float64(energy-prev) / 1e6 / elapsed, true
+}
 
-	status := ServerStatus{
-		OllamaURL:     ollamaBaseURL,
-		Connected:     connected,
-		PortListening: port,
+// gpuDriver names the kernel driver bound to the card ("i915", "xe"), from
+// the basename of its device/driver symlink, or "unknown".
+func gpuDriver(cardPath string) string {
+	target, err := os.Readlink(filepath.Join(cardPath, "device", "driver"))
+	if err != nil {
+		return "unknown"
 	}
+	return filepath.Base(target)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(status)
+// freqPath is where the driver exposes the current GPU clock in MHz: i915
+// has it on the card, xe per GT under the device.
+func (p *arcProvider) freqPath() string {
+	if p.driver == "xe" {
+		return filepath.Join(p.cardPath, "device", "tile0", "gt0", "freq0", "cur_freq")
+	}
+	return filepath.Join(p.cardPath, "gt_cur_freq_mhz")
 }
 
-func handleOllamaAction(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+func (p *arcProvider) Sample() (GpuStats, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hwmonPath == "" {
+		matches, _ := filepath.Glob(filepath.Join(p.cardPath, "device", "hwmon", "hwmon*"))
+		if len(matches) == 0 {
+			return GpuStats{}, fmt.Errorf("no hwmon directory under %s", p.cardPath)
+		}
+		p.hwmonPath = matches[0]
+	}
+	if p.driver == "" {
+		p.driver = gpuDriver(p.cardPath)
 	}
 
-	var req ClientRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	stats := GpuStats{Device: filepath.Base(p.cardPath), Driver: p.driver, UpdatedAt: time.Now()}
+	if v, err := readSysfsInt(filepath.Join(p.hwmonPath, "temp1_input")); err == nil {
+		stats.TempC = float64(v) / 1000
+	}
+	if v, err := readSysfsInt(filepath.Join(p.hwmonPath, "power1_input")); err == nil {
+		stats.PowerWatts = float64(v) / 1e6
+	} else if w, ok := p.energyPower(); ok {
+		stats.PowerWatts = w
 	}
+	if v, err := readSysfsInt(p.freqPath()); err == nil {
+		stats.FreqMHz = int(v)
+	}
+	if v, err := readSysfsInt(filepath.Join(p.cardPath, "device", "mem_info_vram_used")); err == nil {
+		stats.VramUsed = uint64(v)
+	}
+	if v, err := readSysfsInt(filepath.Join(p.cardPath, "device", "mem_info_vram_total")); err == nil {
+		stats.VramTotal = uint64(v)
+	} else {
+		stats.VramTotal = gpuVramTotal
+	}
+	return stats, nil
+}
 
-	switch req.ActionType {
-	case "generate":
-		streamGenerate(w, req)
-	case "chat":
-		streamChat(w, req)
-	case "pull":
-		modelAction(w, ollamaPullAPI, req.Model)
-	case "delete":
-		modelAction(w, ollamaDeleteAPI, req.Model)
-	default:
-		http.Error(w, "Unknown action", http.StatusBadRequest)
+func readSysfsInt(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
 	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
 }
 
-func streamGenerate(w http.ResponseWriter, req ClientRequest) {
-	payload := OllamaGenerateRequestPayload{
-		Model:   req.Model,
-		Prompt: req.Prompt,
-		Stream: true,
-		Options: map[string]interface{}{
-			"temperature":    req.Params.Temperature,
-			"top_p":          req.Params.TopP,
-			"top_k":          req.Params.TopK,
-			"repeat_penalty": req.Params.RepeatPenalty,
-			"num_predict":    req.Params.NumPredict,
-		},
+// telemetryRestartBackoff is the wait before a panicked sampler restarts.
+var telemetryRestartBackoff = 5 * time.Second
+
+var telemetry = struct {
+	sync.RWMutex
+	stats   GpuStats
+	healthy bool
+}{}
+
+func getArcStats() GpuStats {
+	telemetry.RLock()
+	defer telemetry.RUnlock()
+	return telemetry.stats
+}
+
+func telemetryHealthy() bool {
+	telemetry.RLock()
+	defer telemetry.RUnlock()
+	return telemetry.healthy
+}
+
+// runTelemetry samples the provider every interval. A panicking provider
+// (e.g. the sysfs layout changing under us) is logged, marked unhealthy and
+// restarted after telemetryRestartBackoff instead of taking the server down.
+// It returns when ctx is done.
+func runTelemetry(ctx context.Context, p telemetryProvider, interval time.Duration) {
+	for ctx.Err() == nil {
+		func() {
+			defer func() {
+				if rec := recover(); rec != nil {
+					log.Printf("Telemetry sampler panicked: %v; restarting in %s", rec, telemetryRestartBackoff)
+					telemetry.Lock()
+					telemetry.healthy = false
+					telemetry.Unlock()
+				}
+			}()
+			sampleTelemetry(ctx, p, interval)
+		}()
+		select {
+		case <-time.After(telemetryRestartBackoff):
+		case <-ctx.Done():
+		}
 	}
+}
 
-	streamOllama(w, ollamaGenerateAPI, payload, true)
+func sampleTelemetry(ctx context.Context, p telemetryProvider, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		recordSample(p)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
-func streamChat(w http.ResponseWriter, req ClientRequest) {
-	payload := OllamaChatRequestPayload{
-		Model:    req.Model,
-		Messages: req.Messages,
-		Stream:   true,
-		Options:  map[string]interface{}{},
+// recordSample takes one sample and stores it as the current stats. A read
+// that outlives TELEMETRY_READ_TIMEOUT_MS leaves the last stats in place,
+// marked unhealthy, and returns them with the error.
+func recordSample(p telemetryProvider) (GpuStats, error) {
+	stats, err := sampleWithTimeout(p, telemetryReadTimeout)
+	if stats.VramTotal > stats.VramUsed {
+		stats.VramFree = stats.VramTotal - stats.VramUsed
+	}
+	telemetry.Lock()
+	defer telemetry.Unlock()
+	telemetry.healthy = err == nil
+	if err == nil {
+		telemetry.stats = stats
+	} else if errors.Is(err, errTelemetryTimeout) {
+		return telemetry.stats, err
 	}
+	return stats, err
+}
+
+var errTelemetryTimeout = errors.New("GPU telemetry read timed out")
 
-	streamOllama(w, ollamaChatAPI, payload, false)
+// pendingSample is a Sample still running after its caller gave up on it.
+// Sysfs reads can hang, e.g. during a driver reset; later callers wait on
+// that same read rather than piling up goroutines stuck behind it.
+var pendingSample struct {
+	sync.Mutex
+	result chan sampleResult
 }
 
-func streamOllama(w http.ResponseWriter, url string, payload interface{}, useResponse bool) {
-	data, _ := json.Marshal(payload)
+type sampleResult struct {
+	stats GpuStats
+	err   error
+	// panicked carries a panic from the reading goroutine back to the
+	// caller, so runTelemetry still recovers and restarts the sampler.
+	panicked interface{}
+}
 
-	httpReq, _ := http.NewRequest("POST", url, bytes.NewBuffer(data))
-	httpReq.Header.Set("Content-Type", "application/json")
+// sampleBlocked reports whether a timed-out read has yet to return.
+func sampleBlocked() bool {
+	pendingSample.Lock()
+	defer pendingSample.Unlock()
+	return pendingSample.result != nil
+}
 
-	resp, err := httpClient.Do(httpReq)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
-		return
+func sampleWithTimeout(p telemetryProvider, timeout time.Duration) (GpuStats, error) {
+	if timeout <= 0 {
+		return p.Sample()
 	}
-	defer resp.Body.Close()
+	pendingSample.Lock()
+	result := pendingSample.result
+	started := result == nil
+	if started {
+		result = make(chan sampleResult, 1)
+		pendingSample.result = result
+		go func() {
+			defer func() {
+				if rec := recover(); rec != nil {
+					result <- sampleResult{panicked: rec}
+				}
+			}()
+			stats, err := p.Sample()
+			result <- sampleResult{stats: stats, err: err}
+		}()
+	}
+	pendingSample.Unlock()
 
-	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+	select {
+	case res := <-result:
+		pendingSample.Lock()
+		pendingSample.result = nil
+		pendingSample.Unlock()
+		if res.panicked != nil {
+			panic(res.panicked)
+		}
+		return res.stats, res.err
+	case <-time.After(timeout):
+		if started {
+			log.Printf("GPU telemetry read still blocked after %s; serving the last sample", timeout)
+		}
+		return GpuStats{}, fmt.Errorf("%w after %s", errTelemetryTimeout, timeout)
+	}
+}
 
-	flusher := w.(http.Flusher)
-	scanner := bufio.NewScanner(resp.Body)
-	scanner.Buffer(make([]byte, 1024), 1024*1024)
+// handleGPUReset drops the cached sysfs paths and readings and probes the
+// GPU afresh, for when the driver was reloaded or the card swapped.
+func handleGPUReset(w http.ResponseWriter, r *http.Request) {
+	if !requireToken(w, r) {
+		return
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.TrimSpace(line) == "" {
-			continue
-		}
+	// reset waits for the provider lock, which a hung read never releases.
+	if sampleBlocked() {
+		http.Error(w, "GPU probe failed: a telemetry read is still blocked", http.StatusServiceUnavailable)
+		return
+	}
+	gpu.reset()
+	telemetry.Lock()
+	telemetry.stats, telemetry.healthy = GpuStats{}, false
+	telemetry.Unlock()
 
-		fmt.Fprintf(w, "data: %s\n\n", line)
-		flusher.Flush()
+	stats, err := recordSample(gpu)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("GPU probe failed: %v", err), http.StatusServiceUnavailable)
+		return
 	}
+	log.Printf("GPU telemetry reset by %s: %s (%s)", r.RemoteAddr, stats.Device, stats.Driver)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(stats)
 }
 
-func modelAction(w http.ResponseWriter, url, model string) {
-	payload := OllamaModelActionPayload{Model: model}
-	data, _ := json.Marshal(payload)
+func handleGPU(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(getArcStats())
+}
 
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(data))
-	req.Header.Set("Content-Type", "application/json")
+// logPollInterval is how often a tailed log file is checked for new lines.
+const logPollInterval = 500 * time.Millisecond
 
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
+// handleOllamaLogs streams Ollama's log as it grows, one "log" event per
+// line: from OLLAMA_LOG_PATH, or from journalctl when OLLAMA_LOG_SOURCE is
+// journald. Only new lines are sent, not the existing log.
+func handleOllamaLogs(w http.ResponseWriter, r *http.Request) {
+	if !requireToken(w, r) {
 		return
 	}
-	defer resp.Body.Close()
+	if ollamaLogSource != "journald" && ollamaLogPath == "" {
+		http.Error(w, "Ollama logs are not configured: set OLLAMA_LOG_PATH or OLLAMA_LOG_SOURCE=journald", http.StatusNotFound)
+		return
+	}
+	if !acquireSSE(w) {
+		return
+	}
+	defer releaseSSE()
+	sse := newSSEWriter(w)
+	sse.flush()
 
-	body, _ := io.ReadAll(resp.Body)
-	w.Write(body)
+	emit := func(line string) {
+		sse.emit(map[string]string{"type": "log", "line": line})
+	}
+	ctx, cancel := streamContext(r)
+	defer cancel()
+	var err error
+	if ollamaLogSource == "journald" {
+		err = followJournal(ctx, emit)
+	} else {
+		err = tailFile(ctx, ollamaLogPath, emit)
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Printf("Ollama logs: %v", err)
+		sse.emit(errorEvent(err))
+	}
 }
 
-func handleListModels(w http.ResponseWriter, _ *http.Request) {
-	resp, err := httpClient.Get(ollamaTagsAPI)
+// followJournal streams the ollama unit's journal until ctx is done.
+func followJournal(ctx context.Context, emit func(string)) error {
+	cmd := exec.CommandContext(ctx, "journalctl", "-u", "ollama", "-f", "-n", "0", "-o", "cat")
+	out, err := cmd.StdoutPipe()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
-		return
+		return err
 	}
-	defer resp.Body.Close()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(out)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		emit(scanner.Text())
+	}
+	return cmd.Wait()
+}
+
+// tailFile sends each line appended to path until ctx is done. A file that
+// is rotated or truncated is followed from the start of the new content.
+func tailFile(ctx context.Context, path string, emit func(string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	rd := bufio.NewReader(f)
+	partial := ""
+	ticker := time.NewTicker(logPollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			line, err := rd.ReadString('\n')
+			offset += int64(len(line))
+			if err != nil {
+				partial += line
+				break
+			}
+			emit(strings.TrimRight(partial+line, "\r\n"))
+			partial = ""
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
 
-	io.Copy(w, resp.Body)
+		opened, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		current, err := os.Stat(path)
+		if err != nil {
+			continue // mid-rotation; the new file will appear
+		}
+		if os.SameFile(opened, current) && current.Size() >= offset {
+			continue
+		}
+		f.Close()
+		if f, err = os.Open(path); err != nil {
+			return err
+		}
+		rd.Reset(f)
+		offset, partial = 0, ""
+	}
 }
 
 // HTML CONTENT UNCHANGED
@@ -374,6 +6614,14 @@ const htmlContent = `<!DOCTYPE html>
                     <input type="range" id="max-tokens-slider" class="slider" min="50" max="4096" step="50" value="512">
                     <span id="max-tokens-value" class="param-value">512</span>
                 </div>
+                <div class="slider-container">
+                    <label class="w-32 text-sm font-semibold text-gray-700">Thinking:</label>
+                    <select id="think-select" class="px-3 py-1 border border-gray-300 rounded-lg text-sm">
+                        <option value="">Model default</option>
+                        <option value="true">On</option>
+                        <option value="false">Off</option>
+                    </select>
+                </div>
             </div>
         </div>
 
@@ -438,7 +6686,8 @@ const htmlContent = `<!DOCTYPE html>
 
                 <div>
                     <h3 class="font-semibold text-gray-800 mb-3">Pull Model</h3>
-                    <input type="text" id="model-name-input" class="w-full px-4 py-2 border border-gray-300 rounded-lg focus:outline-none focus:ring-2 focus:ring-indigo-500 mb-4" placeholder="e.g., llama2, mistral, phi">
+                    <input type="text" id="model-name-input" list="model-suggestions" autocomplete="off" class="w-full px-4 py-2 border border-gray-300 rounded-lg focus:outline-none focus:ring-2 focus:ring-indigo-500 mb-4" placeholder="e.g., llama2, mistral, phi">
+                    <datalist id="model-suggestions"></datalist>
                     <button id="pull-model-btn" class="w-full bg-green-600 hover:bg-green-700 text-white font-bold py-2 px-4 rounded-lg transition">
                         Pull Model
                     </button>
@@ -507,6 +6756,9 @@ const htmlContent = `<!DOCTYPE html>
             chatMessages: [],
             isLoading: false,
             abortController: null,
+            requestId: null,
+            cancelled: false,
+            welcome: null,
         };
 
         const els = {
@@ -547,14 +6799,55 @@ const htmlContent = `<!DOCTYPE html>
         };
 
         document.addEventListener('DOMContentLoaded', () => {
-            fetchModels();
-            checkServerStatus();
             setupEventListeners();
             setupParameterSliders();
             setupTabButtons();
-            setInterval(checkServerStatus, 5000);
+            applyEnabledActions();
+            fetchModels();
+            subscribeEvents();
+            loadWelcome();
         });
 
+        // The welcome greeting is shown at the top of each new chat but kept
+        // out of state.chatMessages, so it is never sent to the model.
+        async function loadWelcome() {
+            try {
+                const response = await fetch('/api/session');
+                if (!response.ok) return;
+                state.welcome = (await response.json()).welcome || null;
+            } catch (err) {
+                return;
+            }
+            if (state.chatMessages.length === 0) showWelcome();
+        }
+
+        function showWelcome() {
+            if (state.welcome) appendChatMessage('assistant', state.welcome.content);
+        }
+
+        // Model list and connectivity are pushed by /api/events. EventSource
+        // retries a dropped connection itself but gives up on a non-200
+        // reply, such as the 503 from MAX_SSE_CONNECTIONS, so a closed source
+        // is reopened here with a growing delay.
+        function subscribeEvents(retryMs = 1000) {
+            const source = new EventSource('/api/events');
+            source.onopen = () => { retryMs = 1000; };
+            source.onmessage = (e) => {
+                const event = JSON.parse(e.data);
+                if (event.type === 'status') {
+                    event.connected ? setConnected() : setDisconnected();
+                } else if (event.type === 'models') {
+                    renderModels(event.models || []);
+                }
+            };
+            source.onerror = () => {
+                setDisconnected();
+                if (source.readyState === EventSource.CLOSED) {
+                    setTimeout(() => subscribeEvents(Math.min(retryMs * 2, 30000)), retryMs);
+                }
+            };
+        }
+
         function setupParameterSliders() {
             [
                 { slider: els.temperatureSlider, display: els.temperatureValue },
@@ -598,24 +6891,31 @@ const htmlContent = `<!DOCTYPE html>
             });
         }
 
-        async function checkServerStatus() {
-            try {
-                const response = await fetch('/api/status');
-                const data = await response.json();
-                if (data.connected) {
-                    els.statusLight.classList.remove('status-disconnected');
-                    els.statusLight.classList.add('status-connected');
-                    els.statusText.textContent = 'Connected';
-                    els.statusText.classList.remove('text-red-600');
-                    els.statusText.classList.add('text-green-600');
+        // Hide tabs whose actions ENABLED_ACTIONS turns off on the server.
+        function applyEnabledActions() {
+            const enabled = window.WEBOLLA_ENABLED_ACTIONS || [];
+            const tabActions = { generate: ['generate'], chat: ['chat'], models: ['pull', 'delete', 'copy', 'show'] };
+            const visible = [];
+            els.tabButtons.forEach(btn => {
+                if (tabActions[btn.dataset.tab].some(a => enabled.includes(a))) {
+                    visible.push(btn);
                 } else {
-                    setDisconnected();
+                    btn.classList.add('hidden');
                 }
-            } catch (error) {
-                setDisconnected();
+            });
+            if (visible.length && !visible.some(btn => btn.classList.contains('active'))) {
+                visible[0].click();
             }
         }
 
+        function setConnected() {
+            els.statusLight.classList.remove('status-disconnected');
+            els.statusLight.classList.add('status-connected');
+            els.statusText.textContent = 'Connected';
+            els.statusText.classList.remove('text-red-600');
+            els.statusText.classList.add('text-green-600');
+        }
+
         function setDisconnected() {
             els.statusLight.classList.remove('status-connected');
             els.statusLight.classList.add('status-disconnected');
@@ -628,31 +6928,37 @@ const htmlContent = `<!DOCTYPE html>
             try {
                 const response = await fetch('/api/models');
                 const data = await response.json();
-                els.modelSelect.innerHTML = '';
-                els.installedModelsSelect.innerHTML = '';
-                
-                if (data.models && data.models.length > 0) {
-                    data.models.forEach(model => {
-                        const option = document.createElement('option');
-                        option.value = model.name;
-                        option.textContent = model.name;
-                        els.modelSelect.appendChild(option);
-                        
-                        const option2 = document.createElement('option');
-                        option2.value = model.name;
-                        option2.textContent = model.name;
-                        els.installedModelsSelect.appendChild(option2);
-                    });
-                } else {
-                    const option = document.createElement('option');
-                    option.textContent = 'No models available';
-                    els.modelSelect.appendChild(option);
-                }
+                renderModels(data.models || []);
             } catch (error) {
                 showError('Failed to load models: ' + error.message);
             }
         }
 
+        function renderModels(models) {
+            const selected = els.modelSelect.value;
+            els.modelSelect.innerHTML = '';
+            els.installedModelsSelect.innerHTML = '';
+
+            if (models.length > 0) {
+                models.forEach(model => {
+                    const option = document.createElement('option');
+                    option.value = model.name;
+                    option.textContent = model.name;
+                    els.modelSelect.appendChild(option);
+
+                    const option2 = document.createElement('option');
+                    option2.value = model.name;
+                    option2.textContent = model.name;
+                    els.installedModelsSelect.appendChild(option2);
+                });
+                if (models.some(m => m.name === selected)) els.modelSelect.value = selected;
+            } else {
+                const option = document.createElement('option');
+                option.textContent = 'No models available';
+                els.modelSelect.appendChild(option);
+            }
+        }
+
         function setupEventListeners() {
             els.generateBtn.addEventListener('click', handleGenerate);
             els.generateCancelBtn.addEventListener('click', handleCancel);
@@ -661,6 +6967,7 @@ const htmlContent = `<!DOCTYPE html>
             els.clearChatBtn.addEventListener('click', () => {
                 state.chatMessages = [];
                 els.chatHistory.innerHTML = '';
+                showWelcome();
             });
             els.exportChatBtn.addEventListener('click', exportChat);
             els.showThinkingCheckbox.addEventListener('change', () => {
@@ -678,9 +6985,17 @@ const htmlContent = `<!DOCTYPE html>
             });
             document.getElementById('refresh-models-btn').addEventListener('click', fetchModels);
             document.getElementById('pull-model-btn').addEventListener('click', handlePullModel);
+            document.getElementById('model-name-input').addEventListener('input', suggestModels);
             document.getElementById('delete-model-btn').addEventListener('click', handleDeleteModel);
         }
 
+        // thinkSetting is undefined for the model default, which drops the
+        // field from the request body.
+        function thinkSetting() {
+            const value = document.getElementById('think-select').value;
+            return value === '' ? undefined : value === 'true';
+        }
+
         function getParams() {
             return {
                 temperature: parseFloat(els.temperatureSlider.value),
@@ -719,7 +7034,7 @@ const htmlContent = `<!DOCTYPE html>
                 const response = await fetch('/api/ollama-action', {
                     method: 'POST',
                     headers: { 'Content-Type': 'application/json' },
-                    body: JSON.stringify({ actionType: 'generate', model, prompt, params: getParams() }),
+                    body: JSON.stringify({ actionType: 'generate', model, prompt, params: getParams(), think: thinkSetting(), stream: true, requestId: newRequestId() }),
                 });
 
                 if (!response.ok) throw new Error(await response.text());
@@ -742,6 +7057,35 @@ const htmlContent = `<!DOCTYPE html>
                             if (data === '[DONE]') continue;
                             try {
                                 const json = JSON.parse(data);
+                                if (json.type === 'stats') {
+                                    handleStats(json);
+                                    continue;
+                                }
+                                if (json.type === 'loading') {
+                                    els.statusProcessing.textContent = '⏳ Loading model... ' + (json.elapsed_ms / 1000).toFixed(0) + 's';
+                                    continue;
+                                }
+                                if (json.type === 'queued') {
+                                    els.statusProcessing.textContent = '⏳ Queued: #' + json.position + ' in line';
+                                    continue;
+                                }
+                                if (json.error) {
+                                    showError(json.error);
+                                    continue;
+                                }
+                                if (json.type === 'stopped') {
+                                    if (json.reason !== 'cancelled') {
+                                        showError('Stopped early: the output was repeating itself');
+                                    } else if (!state.cancelled) {
+                                        showError('Request cancelled');
+                                    }
+                                    continue;
+                                }
+                                if (json.type === 'thinking') {
+                                    els.thinkingOutput.textContent += json.content;
+                                    els.thinkingOutput.scrollTop = els.thinkingOutput.scrollHeight;
+                                    continue;
+                                }
                                 if (json.response) {
                                     els.responseOutput.textContent += json.response;
                                     tokenCount++;
@@ -816,7 +7160,7 @@ const htmlContent = `<!DOCTYPE html>
                 const response = await fetch('/api/ollama-action', {
                     method: 'POST',
                     headers: { 'Content-Type': 'application/json' },
-                    body: JSON.stringify({ actionType: 'chat', model, messages: state.chatMessages, params: getParams() }),
+                    body: JSON.stringify({ actionType: 'chat', model, messages: state.chatMessages, params: getParams(), think: thinkSetting(), stream: true, requestId: newRequestId() }),
                 });
 
                 if (!response.ok) throw new Error(await response.text());
@@ -842,6 +7186,35 @@ const htmlContent = `<!DOCTYPE html>
                             if (data === '[DONE]') continue;
                             try {
                                 const json = JSON.parse(data);
+                                if (json.type === 'stats') {
+                                    handleStats(json);
+                                    continue;
+                                }
+                                if (json.type === 'loading') {
+                                    els.statusProcessing.textContent = '⏳ Loading model... ' + (json.elapsed_ms / 1000).toFixed(0) + 's';
+                                    continue;
+                                }
+                                if (json.type === 'queued') {
+                                    els.statusProcessing.textContent = '⏳ Queued: #' + json.position + ' in line';
+                                    continue;
+                                }
+                                if (json.error) {
+                                    showError(json.error);
+                                    continue;
+                                }
+                                if (json.type === 'stopped') {
+                                    if (json.reason !== 'cancelled') {
+                                        showError('Stopped early: the output was repeating itself');
+                                    } else if (!state.cancelled) {
+                                        showError('Request cancelled');
+                                    }
+                                    continue;
+                                }
+                                if (json.type === 'thinking') {
+                                    els.thinkingOutput.textContent += json.content;
+                                    els.thinkingOutput.scrollTop = els.thinkingOutput.scrollHeight;
+                                    continue;
+                                }
                                 if (json.message && json.message.content) {
                                     assistantResponse += json.message.content;
                                     messageEl.textContent = assistantResponse;
@@ -861,12 +7234,6 @@ const htmlContent = `<!DOCTYPE html>
                                         els.tokensPerSec.textContent = tokensPerSecond + ' tok/s';
                                         lastTokenTime = Date.now();
                                     }
-
-                                    // Show thinking in panel if checkbox enabled
-                                    if (els.showThinkingCheckbox.checked && json.message.content) {
-                                        els.thinkingOutput.textContent += json.message.content;
-                                        els.thinkingOutput.scrollTop = els.thinkingOutput.scrollHeight;
-                                    }
                                 }
 
                                 if (json.model) {
@@ -892,7 +7259,22 @@ const htmlContent = `<!DOCTYPE html>
             }
         }
 
+        // Each generation gets an ID the server can cancel it by.
+        function newRequestId() {
+            state.cancelled = false;
+            state.requestId = Date.now().toString(36) + Math.random().toString(36).slice(2);
+            return state.requestId;
+        }
+
         function handleCancel() {
+            if (state.requestId) {
+                state.cancelled = true;
+                fetch('/api/cancel', {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify({ requestId: state.requestId }),
+                }).catch(() => {});
+            }
             state.isLoading = false;
             els.generateBtn.classList.remove('hidden');
             els.generateCancelBtn.classList.add('hidden');
@@ -901,6 +7283,12 @@ const htmlContent = `<!DOCTYPE html>
             showSuccess('Cancelled');
         }
 
+        function handleStats(stats) {
+            if (stats.done_reason === 'length') {
+                showError('Truncated — hit token limit');
+            }
+        }
+
         function appendChatMessage(role, content) {
             const messageEl = document.createElement('div');
             messageEl.classList.add('chat-message', role);
@@ -933,6 +7321,29 @@ const htmlContent = `<!DOCTYPE html>
             URL.revokeObjectURL(url);
         }
 
+        async function suggestModels(e) {
+            const prefix = e.target.value.trim();
+            const list = document.getElementById('model-suggestions');
+            if (!prefix) {
+                list.innerHTML = '';
+                return;
+            }
+            try {
+                const response = await fetch('/api/complete?prefix=' + encodeURIComponent(prefix));
+                if (!response.ok) return;
+                const suggestions = await response.json();
+                list.innerHTML = '';
+                suggestions.forEach(s => {
+                    const option = document.createElement('option');
+                    option.value = s.name;
+                    if (s.installed) option.label = s.name + ' (installed)';
+                    list.appendChild(option);
+                });
+            } catch (error) {
+                // Suggestions are best effort; typing still works without them.
+            }
+        }
+
         async function handlePullModel() {
             const modelName = document.getElementById('model-name-input').value.trim();
             if (!modelName) return showError('Please enter a model name');
@@ -992,4 +7403,3 @@ const htmlContent = `<!DOCTYPE html>
     </script>
 </body>
 </html>`
-